@@ -1,51 +1,53 @@
 package chaincache
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	aero "github.com/aerospike/aerospike-client-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AerocacherCfg struct {
-	Hosts []string `yaml:"hosts"`
+	Hosts []string `yaml:"hosts" json:"hosts"`
 
-	Username  string `yaml:"username"`
-	Password  string `yaml:"password"`
-	Namespace string `yaml:"namespace"`
-	SetName   string `yaml:"set"`
-	BinName   string `yaml:"bin"`
+	Username  string `yaml:"username" json:"username"`
+	Password  string `yaml:"password" json:"password"`
+	Namespace string `yaml:"namespace" json:"namespace"`
+	SetName   string `yaml:"set" json:"set"`
+	BinName   string `yaml:"bin" json:"bin"`
 
-	ConnectTimeoutMs int64 `yaml:"connect_timeout_ms"` //=30 sec
-	IdleTimeoutMs    int64 `yaml:"idle_timeout_ms"`    //=55 sec
-	LoginTimeoutMs   int64 `yaml:"login_timeout_ms"`   //=10 sec
+	ConnectTimeoutMs int64 `yaml:"connect_timeout_ms" json:"connect_timeout_ms"` //=30 sec
+	IdleTimeoutMs    int64 `yaml:"idle_timeout_ms" json:"idle_timeout_ms"`       //=55 sec
+	LoginTimeoutMs   int64 `yaml:"login_timeout_ms" json:"login_timeout_ms"`     //=10 sec
 
-	ConnectionQueueSize        int `yaml:"connection_queue_size"`        //=256
-	OpeningConnectionThreshold int `yaml:"opening_connection_threshold"` //=0
-	MinConnectionsPerNode      int `yaml:"min_connections_per_node"`     //=0
+	ConnectionQueueSize        int `yaml:"connection_queue_size" json:"connection_queue_size"`               //=256
+	OpeningConnectionThreshold int `yaml:"opening_connection_threshold" json:"opening_connection_threshold"` //=0
+	MinConnectionsPerNode      int `yaml:"min_connections_per_node" json:"min_connections_per_node"`         //=0
 }
 
 type Aerocacher struct {
+	cacherStats
+
 	cfg    *AerocacherCfg
 	client *aero.Client
 
-	inited         bool
-	hits           uint32
-	misses         uint32
-	requestTimeSum float64
-	requestCount   uint32
+	// Tracer of aerospike requests, spans are children of the span in the context of a request, nil disables tracing
+	Tracer trace.Tracer
+
+	// shifts TTLs of written keys, nil disables
+	Jitter *Jitter
+
+	inited bool
 }
 
 func NewAerocacher(cfg *AerocacherCfg) (*Aerocacher, error) {
 	aerocacher := &Aerocacher{
 		cfg: cfg,
 	}
-	atomic.StoreUint32(&aerocacher.hits, 0)
-	atomic.StoreUint32(&aerocacher.misses, 0)
-
 	err := aerocacher.Init()
 	if err != nil {
 		return nil, err
@@ -105,6 +107,75 @@ func (c *Aerocacher) Init() error {
 }
 
 func (c *Aerocacher) Set(key string, payload []byte, ttlSeconds int) error {
+	return c.set(context.Background(), key, payload, ttlSeconds)
+}
+
+func (c *Aerocacher) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds int) error {
+	return c.set(ctx, key, payload, ttlSeconds)
+}
+
+func (c *Aerocacher) Get(key string) ([]byte, error) {
+	data, _, err := c.getWithTTL(context.Background(), key)
+	return data, err
+}
+
+func (c *Aerocacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.getWithTTL(ctx, key)
+	return data, err
+}
+
+func (c *Aerocacher) GetWithTTL(key string) ([]byte, int, error) {
+	return c.getWithTTL(context.Background(), key)
+}
+
+func (c *Aerocacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	return c.getWithTTL(ctx, key)
+}
+
+func (c *Aerocacher) Del(key string) error {
+	return c.del(context.Background(), key)
+}
+
+func (c *Aerocacher) DelCtx(ctx context.Context, key string) error {
+	return c.del(ctx, key)
+}
+
+func (c *Aerocacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
+	return c.set(context.Background(), key, payload, ttlSeconds)
+}
+
+func (c *Aerocacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds int) error {
+	return c.set(ctx, key, payload, ttlSeconds)
+}
+
+func (c *Aerocacher) BGet(key []byte) ([]byte, error) {
+	data, _, err := c.getWithTTL(context.Background(), key)
+	return data, err
+}
+
+func (c *Aerocacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	data, _, err := c.getWithTTL(ctx, key)
+	return data, err
+}
+
+func (c *Aerocacher) BGetWithTTL(key []byte) ([]byte, int, error) {
+	return c.getWithTTL(context.Background(), key)
+}
+
+func (c *Aerocacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	return c.getWithTTL(ctx, key)
+}
+
+func (c *Aerocacher) BDel(key []byte) error {
+	return c.del(context.Background(), key)
+}
+
+func (c *Aerocacher) BDelCtx(ctx context.Context, key []byte) error {
+	return c.del(ctx, key)
+}
+
+// key is string or []byte, aerospike treats them as different keys
+func (c *Aerocacher) set(ctx context.Context, key interface{}, payload []byte, ttlSeconds int) error {
 	if !c.inited {
 		return ErrNotInited
 	}
@@ -118,20 +189,31 @@ func (c *Aerocacher) Set(key string, payload []byte, ttlSeconds int) error {
 	aeroBins := aero.BinMap{}
 	aeroBins[c.cfg.BinName] = payload
 
+	switch k := key.(type) {
+	case string:
+		ttlSeconds = c.Jitter.stringTTL(k, ttlSeconds)
+	case []byte:
+		ttlSeconds = c.Jitter.bytesTTL(k, ttlSeconds)
+	}
+
 	wpolicy := aero.NewWritePolicy(0, uint32(ttlSeconds))
+	if err := applyDeadline(ctx, &wpolicy.BasePolicy); err != nil {
+		return err
+	}
+	_, sp := c.startSpan(ctx, "put", key)
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(payload))
+	sp.setInt(ATTR_TTL, ttlSeconds)
 	start := time.Now()
 	err = c.client.Put(wpolicy, aeroKey, aeroBins)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
+	c.done(opSet, start, err)
+	sp.end(err)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
 	return err
 }
 
-func (c *Aerocacher) Get(key string) ([]byte, error) {
-	data, _, err := c.GetWithTTL(key)
-	return data, err
-}
-
-func (c *Aerocacher) GetWithTTL(key string) ([]byte, int, error) {
+func (c *Aerocacher) getWithTTL(ctx context.Context, key interface{}) ([]byte, int, error) {
 	if !c.inited {
 		return nil, 0, ErrNotInited
 	}
@@ -142,20 +224,29 @@ func (c *Aerocacher) GetWithTTL(key string) ([]byte, int, error) {
 		return nil, 0, err
 	}
 
+	policy := *c.client.DefaultPolicy
+	if err := applyDeadline(ctx, &policy); err != nil {
+		return nil, 0, err
+	}
+	_, sp := c.startSpan(ctx, "get", key)
 	start := time.Now()
-	rec, err := c.client.Get(nil, aeroKey)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
+	rec, err := c.client.Get(&policy, aeroKey)
 	if err != nil {
-		atomic.AddUint32(&c.misses, 1)
-		return nil, 0, ErrMiss
+		err = ErrMiss
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		c.done(opGet, start, err)
+		sp.end(err)
+		return nil, 0, err
 	}
+	c.done(opGet, start, nil)
+	sp.end(nil)
 
-	atomic.AddUint32(&c.hits, 1)
 	return rec.Bins[c.cfg.BinName].([]byte), int(rec.Expiration), nil
 }
 
-func (c *Aerocacher) Del(key string) error {
+func (c *Aerocacher) del(ctx context.Context, key interface{}) error {
 	if !c.inited {
 		return ErrNotInited
 	}
@@ -165,96 +256,143 @@ func (c *Aerocacher) Del(key string) error {
 	}
 
 	wpolicy := aero.NewWritePolicy(0, 0)
+	if err := applyDeadline(ctx, &wpolicy.BasePolicy); err != nil {
+		return err
+	}
+	_, sp := c.startSpan(ctx, "delete", key)
 	start := time.Now()
 	deleted, err := c.client.Delete(wpolicy, aeroKey)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
-	if err != nil {
-		return err
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
 	}
-	if !deleted {
-		return ErrMiss
+	if err == nil && !deleted {
+		err = ErrMiss
 	}
+	c.done(opDel, start, err)
+	sp.end(err)
+	return err
+}
 
-	return nil
+func (c *Aerocacher) MGet(keys []string) ([]Item, []string, error) {
+	return c.mget(context.Background(), keys)
 }
 
-func (c *Aerocacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	// log.Printf("Aerocache: set %s", key)
+func (c *Aerocacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return c.mget(ctx, keys)
+}
 
-	aeroKey, err := aero.NewKey(c.cfg.Namespace, c.cfg.SetName, key)
-	if err != nil {
-		return err
-	}
+// MGetWithTTL is the same as MGet, aerospike returns expiration with the record anyway
+func (c *Aerocacher) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	return c.mget(context.Background(), keys)
+}
 
-	aeroBins := aero.BinMap{}
-	aeroBins[c.cfg.BinName] = payload
+func (c *Aerocacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return c.mget(ctx, keys)
+}
 
-	wpolicy := aero.NewWritePolicy(0, uint32(ttlSeconds))
-	start := time.Now()
-	err = c.client.Put(wpolicy, aeroKey, aeroBins)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
-	return err
+// MSet writes records one by one, the client has no batch writes
+func (c *Aerocacher) MSet(items []Item) error {
+	return c.MSetCtx(context.Background(), items)
 }
 
-func (c *Aerocacher) BGet(key []byte) ([]byte, error) {
-	data, _, err := c.BGetWithTTL(key)
-	return data, err
+func (c *Aerocacher) MSetCtx(ctx context.Context, items []Item) error {
+	return msetEach(items, func(key string, payload []byte, ttl int) error {
+		return c.set(ctx, key, payload, ttl)
+	})
 }
 
-func (c *Aerocacher) BGetWithTTL(key []byte) ([]byte, int, error) {
+func (c *Aerocacher) MDel(keys []string) error {
+	return c.MDelCtx(context.Background(), keys)
+}
+
+func (c *Aerocacher) MDelCtx(ctx context.Context, keys []string) error {
+	return mdelEach(keys, func(key string) error {
+		return c.del(ctx, key)
+	})
+}
+
+func (c *Aerocacher) mget(ctx context.Context, keys []string) ([]Item, []string, error) {
 	if !c.inited {
-		return nil, 0, ErrNotInited
+		return nil, nil, ErrNotInited
+	}
+	if len(keys) == 0 {
+		return nil, nil, nil
 	}
-	// log.Printf("Aerocache: get %s", key)
 
-	aeroKey, err := aero.NewKey(c.cfg.Namespace, c.cfg.SetName, key)
-	if err != nil {
-		return nil, 0, err
+	aeroKeys := make([]*aero.Key, len(keys))
+	for ix, key := range keys {
+		aeroKey, err := aero.NewKey(c.cfg.Namespace, c.cfg.SetName, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		aeroKeys[ix] = aeroKey
 	}
 
+	policy := *c.client.DefaultBatchPolicy
+	if err := applyDeadline(ctx, &policy.BasePolicy); err != nil {
+		return nil, nil, err
+	}
+	_, sp := startDBBatchSpan(ctx, c.Tracer, "aerospike", "batch_get", len(keys))
 	start := time.Now()
-	rec, err := c.client.Get(nil, aeroKey)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
+	recs, err := c.client.BatchGet(&policy, aeroKeys, c.cfg.BinName)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	sp.end(err)
 	if err != nil {
-		atomic.AddUint32(&c.misses, 1)
-		return nil, 0, ErrMiss
+		c.doneBatch(opGet, start, 0, 0, err)
+		return nil, nil, err
 	}
 
-	atomic.AddUint32(&c.hits, 1)
-	return rec.Bins[c.cfg.BinName].([]byte), int(rec.Expiration), nil
+	items := make([]Item, 0, len(keys))
+	var misses []string
+	for ix, rec := range recs {
+		if rec == nil {
+			misses = append(misses, keys[ix])
+			continue
+		}
+		val, _ := rec.Bins[c.cfg.BinName].([]byte)
+		items = append(items, Item{Key: keys[ix], Value: val, TTL: int(rec.Expiration)})
+	}
+	c.doneBatch(opGet, start, len(items), len(misses), nil)
+	return items, misses, nil
 }
 
-func (c *Aerocacher) BDel(key []byte) error {
-	if !c.inited {
-		return ErrNotInited
+// startSpan starts a span of the request for a string or []byte key
+func (c *Aerocacher) startSpan(ctx context.Context, op string, key interface{}) (context.Context, span) {
+	if c.Tracer == nil {
+		return ctx, span{}
 	}
-	aeroKey, err := aero.NewKey(c.cfg.Namespace, c.cfg.SetName, key)
-	if err != nil {
-		return err
+	if b, ok := key.([]byte); ok {
+		return startDBSpan(ctx, c.Tracer, "aerospike", op, bytesKey(b))
 	}
+	return startDBSpan(ctx, c.Tracer, "aerospike", op, stringKey(key.(string)))
+}
 
-	wpolicy := aero.NewWritePolicy(0, 0)
-	start := time.Now()
-	deleted, err := c.client.Delete(wpolicy, aeroKey)
-	c.requestCount++
-	c.requestTimeSum += time.Since(start).Seconds()
-	if err != nil {
+// applyDeadline limits total timeout of the aerospike policy by the deadline of ctx,
+// the client has no context support, so it is the only way to stop waiting for the server
+func applyDeadline(ctx context.Context, policy *aero.BasePolicy) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if !deleted {
-		return ErrMiss
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return context.DeadlineExceeded
+	}
+	if policy.TotalTimeout == 0 || timeout < policy.TotalTimeout {
+		policy.TotalTimeout = timeout
 	}
-
 	return nil
 }
 
-func (c *Aerocacher) Reset() {}
+// Reset resets the statistics only, the data in aerospike is kept
+func (c *Aerocacher) Reset() {
+	c.resetStats()
+}
 
 func (c *Aerocacher) Close() {
 	if !c.inited {
@@ -264,19 +402,9 @@ func (c *Aerocacher) Close() {
 	c.inited = false
 }
 
-func (c *Aerocacher) GetHits() uint32 {
-	return atomic.LoadUint32(&c.hits)
-}
-
-func (c *Aerocacher) GetMisses() uint32 {
-	return atomic.LoadUint32(&c.misses)
-}
-
+// GetAvgRequestTime returns the mean time of a request in seconds
 func (c *Aerocacher) GetAvgRequestTime() float64 {
-	if c.requestCount == 0 {
-		return 0.
-	}
-	return c.requestTimeSum / float64(c.requestCount)
+	return c.avgRequestTime()
 }
 
 // ------------------------------------------------------------------------------------------------
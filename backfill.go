@@ -0,0 +1,151 @@
+package chaincache
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// BackfillMode selects the TTL of values written back to a level when they are found deeper in the chain
+type BackfillMode uint8
+
+const (
+	// the rest of TTL of the found value
+	BACKFILL_REMAINING BackfillMode = iota
+	// the rest of TTL capped by BackfillPolicy.TTL, the unknown rest (0) gives BackfillPolicy.TTL
+	BACKFILL_CAP
+	// BackfillPolicy.TTL whatever the rest of TTL is
+	BACKFILL_FIXED
+	// the level is never backfilled
+	BACKFILL_SKIP
+)
+
+// BackfillPolicy sets how a level of a chain is backfilled. The rest of TTL is not always reliable:
+// Fastcacher without TTL returns 0, Aerocacher returns the expiration of the record on the server
+type BackfillPolicy struct {
+	Mode BackfillMode
+	// seconds, used by BACKFILL_CAP and BACKFILL_FIXED
+	TTL int
+}
+
+// levelTTL returns the TTL of the key to backfill with, false if the level is skipped. The rest of TTL
+// has been jittered when the found value was written, so only TTLs taken from the policy are jittered,
+// and a capped TTL never outlives the found value
+func (p BackfillPolicy) levelTTL(remaining int, jitter *Jitter, key chainKey) (int, bool) {
+	switch p.Mode {
+	case BACKFILL_CAP:
+		if remaining <= 0 {
+			return jitter.keyTTL(key, p.TTL), true
+		}
+		if remaining > p.TTL {
+			if ttl := jitter.keyTTL(key, p.TTL); ttl < remaining {
+				return ttl, true
+			}
+		}
+		return remaining, true
+	case BACKFILL_FIXED:
+		return jitter.keyTTL(key, p.TTL), true
+	case BACKFILL_SKIP:
+		return 0, false
+	}
+	return remaining, true
+}
+
+func (c *ChainCache) backfillPolicy(level int) BackfillPolicy {
+	if level < len(c.Backfill) {
+		return c.Backfill[level]
+	}
+	return BackfillPolicy{}
+}
+
+// backfill writes the value found on the level to the preceding levels, synchronously or in background
+// by AsyncBackfill. Errors of background writes are only reported to the Observer
+func (c *ChainCache) backfill(ctx context.Context, key chainKey, val []byte, ttl int, level int, negative bool) error {
+	if !c.AsyncBackfill {
+		return c.backfillLevels(ctx, key, val, ttl, level, negative)
+	}
+	// the caller owns the key and the value and may reuse them
+	if key.bytes {
+		key = bytesKey(append([]byte(nil), key.b...))
+	}
+	val = append([]byte(nil), val...)
+	ctx = detachSpan(ctx)
+	c.backfills.Add(1)
+	go func() {
+		defer c.backfills.Done()
+		c.backfillLevels(ctx, key, val, ttl, level, negative)
+	}()
+	return nil
+}
+
+func (c *ChainCache) backfillLevels(ctx context.Context, key chainKey, val []byte, ttl int, level int, negative bool) error {
+	for ix := level - 1; ix >= 0; ix-- {
+		levelTTL, ok := c.backfillPolicy(ix).levelTTL(ttl, c.Jitter, key)
+		if !ok {
+			continue
+		}
+		lctx, sp := startLevelSpan(ctx, c.Tracer, "chaincache.level.Backfill", ix)
+		err := key.set(lctx, c.chain[ix], val, levelTTL)
+		sp.end(err)
+		c.levels[ix].backfill(1, err)
+		if err != nil {
+			c.notifyError(ix, "backfill", err)
+			if !c.IgnoreErrors {
+				return err
+			}
+			continue
+		}
+		c.notifyBackfill(ix, key)
+		if negative {
+			atomic.AddUint64(&c.negativeBackfills, 1)
+		}
+	}
+	return nil
+}
+
+// mbackfill is backfill of items found on the level by a batch lookup
+func (c *ChainCache) mbackfill(ctx context.Context, items []Item, level int) error {
+	if !c.AsyncBackfill {
+		return c.mbackfillLevels(ctx, items, level)
+	}
+	// the items are returned to the caller, who may modify them
+	copied := make([]Item, len(items))
+	for ix, item := range items {
+		item.Value = append([]byte(nil), item.Value...)
+		copied[ix] = item
+	}
+	items = copied
+	ctx = detachSpan(ctx)
+	c.backfills.Add(1)
+	go func() {
+		defer c.backfills.Done()
+		c.mbackfillLevels(ctx, items, level)
+	}()
+	return nil
+}
+
+func (c *ChainCache) mbackfillLevels(ctx context.Context, items []Item, level int) error {
+	negatives := uint64(countNegative(items))
+	levelItems := make([]Item, len(items))
+	for ix := level - 1; ix >= 0; ix-- {
+		policy := c.backfillPolicy(ix)
+		if policy.Mode == BACKFILL_SKIP {
+			continue
+		}
+		for i, item := range items {
+			item.TTL, _ = policy.levelTTL(item.TTL, c.Jitter, stringKey(item.Key))
+			levelItems[i] = item
+		}
+		err := c.chain[ix].MSetCtx(ctx, levelItems)
+		c.levels[ix].backfill(len(items), err)
+		if err != nil {
+			c.notifyError(ix, "backfill", err)
+			if !c.IgnoreErrors {
+				return err
+			}
+			continue
+		}
+		c.notifyBackfillItems(ix, levelItems)
+		atomic.AddUint64(&c.negativeBackfills, negatives)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Item is a key with its data, used by batch operations.
+// TTL is filled by MGetWithTTL and used by MSet
+type Item struct {
+	Key   string
+	Value []byte
+	TTL   int
+	// the key is cached as not existing by SetNegative, set by MGet of a chain, Value is nil
+	Negative bool
+}
+
+// mgetEach is MGet for cachers without batch requests support, get must return ErrMiss for missed keys
+func mgetEach(keys []string, get func(key string) ([]byte, int, error)) ([]Item, []string, error) {
+	items := make([]Item, 0, len(keys))
+	var misses []string
+	for _, key := range keys {
+		val, ttl, err := get(key)
+		if err == ErrMiss {
+			misses = append(misses, key)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, Item{Key: key, Value: val, TTL: ttl})
+	}
+	return items, misses, nil
+}
+
+func msetEach(items []Item, set func(key string, payload []byte, ttl int) error) error {
+	for _, item := range items {
+		if err := set(item.Key, item.Value, item.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mdelEach(keys []string, del func(key string) error) error {
+	for _, key := range keys {
+		if err := del(key); err != nil && err != ErrMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ChainCache) encodeValues(items []Item) [][]byte {
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		values[i] = c.encodePayload(item.Value, 0)
+	}
+	return values
+}
+
+func countNegative(items []Item) int {
+	n := 0
+	for _, item := range items {
+		if e, ok := decodeEntry(item.Value); ok && e.negative() {
+			n++
+		}
+	}
+	return n
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// MGet resolves keys level by level: only keys missed by a cacher are asked from the next one,
+// found items are written back to the preceding cachers in bulk unless NoBackwardCache is set.
+// Keys cached as not existing by SetNegative are in found items with Negative set, as Get returns ErrNegativeHit for them
+func (c *ChainCache) MGet(keys []string) ([]Item, []string, error) {
+	return c.mget(context.Background(), keys, c.needTTL())
+}
+
+func (c *ChainCache) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return c.mget(ctx, keys, c.needTTL())
+}
+
+func (c *ChainCache) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	return c.mget(context.Background(), keys, true)
+}
+
+func (c *ChainCache) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return c.mget(ctx, keys, true)
+}
+
+// MSet stores items in every cacher of the chain with the TTL of the level, TTL of items is ignored
+func (c *ChainCache) MSet(items []Item, ttlSeconds []int) error {
+	return c.mset(context.Background(), items, ttlSeconds)
+}
+
+func (c *ChainCache) MSetCtx(ctx context.Context, items []Item, ttlSeconds []int) error {
+	return c.mset(ctx, items, ttlSeconds)
+}
+
+func (c *ChainCache) MDel(keys []string) error {
+	return c.mdel(context.Background(), keys)
+}
+
+func (c *ChainCache) MDelCtx(ctx context.Context, keys []string) error {
+	return c.mdel(ctx, keys)
+}
+
+func (c *ChainCache) mget(ctx context.Context, keys []string, withTTL bool) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+
+	found := make([]Item, 0, len(keys))
+	misses := keys
+	negatives := 0
+	for ix := 0; ix < len(c.chain) && len(misses) > 0; ix++ {
+		var (
+			items []Item
+			rest  []string
+			err   error
+		)
+		cacher := c.chain[ix]
+		start := time.Now()
+		if withTTL {
+			items, rest, err = cacher.MGetWithTTLCtx(ctx, misses)
+		} else {
+			items, rest, err = cacher.MGetCtx(ctx, misses)
+		}
+		if err != nil {
+			c.levels[ix].lookup(start, 0, 0)
+			c.notifyError(ix, "mget", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+			if !c.IgnoreErrors {
+				return nil, nil, err
+			}
+			c.levels[ix].swallowed()
+			continue
+		}
+		for i := range items {
+			// a nested chain reports tombstones by the flag, they are backfilled as tombstones
+			if items[i].Negative {
+				items[i].Value = negativeEntry
+			}
+		}
+		// items of invalidated tags are misses of the level, deeper levels may have fresh ones
+		items, dropped, err := c.dropInvalidated(ctx, items)
+		if err != nil {
+			c.levels[ix].lookup(start, 0, 0)
+			return nil, nil, err
+		}
+		rest = append(rest, dropped...)
+		c.levels[ix].lookup(start, len(items), len(rest))
+		c.notifyHitItems(ix, items)
+
+		if !c.NoBackwardCache && len(items) > 0 && ix > 0 {
+			if err := c.mbackfill(ctx, items, ix); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, item := range items {
+			e, ok := decodeEntry(item.Value)
+			if !ok {
+				e = entry{payload: item.Value}
+			}
+			if e.negative() {
+				negatives++
+				found = append(found, Item{Key: item.Key, TTL: item.TTL, Negative: true})
+				continue
+			}
+			item.Value = e.payload
+			c.revalidate(stringKey(item.Key), &e, item.TTL)
+			found = append(found, item)
+		}
+		misses = rest
+	}
+
+	atomic.AddUint64(&c.hits, uint64(len(found)-negatives))
+	atomic.AddUint64(&c.misses, uint64(len(misses)))
+	atomic.AddUint64(&c.negativeHits, uint64(negatives))
+	c.notifyMissKeys(misses)
+	return found, misses, nil
+}
+
+func (c *ChainCache) mset(ctx context.Context, items []Item, ttlSeconds []int) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	if len(ttlSeconds) != len(c.chain) {
+		return fmt.Errorf("ttl slice size must be equal to your chain size")
+	}
+	values := c.encodeValues(items)
+	levels := make([][]Item, len(c.chain))
+	for ix := range levels {
+		levels[ix] = make([]Item, len(items))
+		for i, item := range items {
+			item.TTL = c.Jitter.stringTTL(item.Key, ttlSeconds[ix])
+			item.Value = values[i]
+			levels[ix][i] = item
+		}
+	}
+	return c.msetLevels(ctx, items, levels)
+}
+
+// msetLevels stores items of every level, items are the stored ones as passed by the caller
+func (c *ChainCache) msetLevels(ctx context.Context, items []Item, levels [][]Item) error {
+	if err := c.stampGroupItems(ctx, levels); err != nil {
+		return err
+	}
+	local := c.localLevels()
+	for ix := 0; ix < local; ix++ {
+		if err := c.chain[ix].MSetCtx(ctx, levels[ix]); err != nil {
+			c.notifyError(ix, "mset", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if !c.IgnoreErrors {
+				return err
+			}
+			c.levels[ix].swallowed()
+		}
+	}
+	if local < len(c.chain) {
+		// write-behind workers publish the keys once the remote levels are written
+		if len(items) > 0 {
+			if err := c.writeBehindMSet(ctx, levels); err != nil {
+				return err
+			}
+		}
+	} else if err := c.publishItems(ctx, items); err != nil {
+		return err
+	}
+	c.notifySetItems(items)
+	return nil
+}
+
+func (c *ChainCache) mdel(ctx context.Context, keys []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	local := c.localLevels()
+	for ix, cacher := range c.chain[:local] {
+		if err := cacher.MDelCtx(ctx, keys); err != nil {
+			c.notifyError(ix, "mdel", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if !c.IgnoreErrors {
+				return err
+			}
+			c.levels[ix].swallowed()
+		}
+	}
+	if local < len(c.chain) {
+		if len(keys) > 0 {
+			if err := c.writeBehindMDel(ctx, keys); err != nil {
+				return err
+			}
+		}
+	} else if err := c.publish(ctx, keys...); err != nil {
+		return err
+	}
+	c.notifyDelKeys(keys)
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// MSet stores items in the chain spreading TTL of every item over the levels by Policy
+func (c *ChainCacher) MSet(items []Item) error {
+	return c.MSetCtx(context.Background(), items)
+}
+
+func (c *ChainCacher) MSetCtx(ctx context.Context, items []Item) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	levels := make([][]Item, len(c.chain))
+	for ix := range levels {
+		levels[ix] = make([]Item, len(items))
+	}
+	values := c.encodeValues(items)
+	for i, item := range items {
+		item.Value = values[i]
+		for ix, ttl := range c.levelTTLs(item.TTL) {
+			item.TTL = c.Jitter.stringTTL(item.Key, ttl)
+			levels[ix][i] = item
+		}
+	}
+	return c.msetLevels(ctx, items, levels)
+}
@@ -1,16 +1,22 @@
 package chaincache
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type Cacher interface {
 	Init() error
 	Reset()
 	Close()
-	GetHits() uint32
-	GetMisses() uint32
+	GetHits() uint64
+	GetMisses() uint64
 
 	Get(key string) ([]byte, error)
 	GetWithTTL(key string) ([]byte, int, error)
@@ -21,6 +27,37 @@ type Cacher interface {
 	BGetWithTTL(key []byte) ([]byte, int, error)
 	BSet(key []byte, payload []byte, ttl int) error
 	BDel(key []byte) error
+
+	// MGet returns found items in order of keys and the list of missed keys
+	MGet(keys []string) ([]Item, []string, error)
+	// MGetWithTTL is MGet which also fills TTL of the found items
+	MGetWithTTL(keys []string) ([]Item, []string, error)
+	// MSet stores every item with its own TTL
+	MSet(items []Item) error
+	// MDel deletes all keys, missed keys are not an error
+	MDel(keys []string) error
+}
+
+// ContextCacher is a Cacher which operations respect cancellation and deadline of the passed context.
+// All cachers of the package implement it, the context-less methods are equal to calling
+// their *Ctx variants with context.Background()
+type ContextCacher interface {
+	Cacher
+
+	GetCtx(ctx context.Context, key string) ([]byte, error)
+	GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error)
+	SetCtx(ctx context.Context, key string, payload []byte, ttl int) error
+	DelCtx(ctx context.Context, key string) error
+
+	BGetCtx(ctx context.Context, key []byte) ([]byte, error)
+	BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error)
+	BSetCtx(ctx context.Context, key []byte, payload []byte, ttl int) error
+	BDelCtx(ctx context.Context, key []byte) error
+
+	MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error)
+	MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error)
+	MSetCtx(ctx context.Context, items []Item) error
+	MDelCtx(ctx context.Context, keys []string) error
 }
 
 var (
@@ -28,27 +65,237 @@ var (
 	ErrNotInited = fmt.Errorf("cacher has not been inited")
 )
 
+// AsContextCacher returns cacher itself if it implements ContextCacher, otherwise wraps it
+// so that every operation checks the context before calling the wrapped cacher
+func AsContextCacher(cacher Cacher) ContextCacher {
+	if cc, ok := cacher.(ContextCacher); ok {
+		return cc
+	}
+	return &contextCacher{cacher}
+}
+
+type contextCacher struct {
+	Cacher
+}
+
+// Unwrap returns the wrapped cacher
+func (c *contextCacher) Unwrap() Cacher {
+	return c.Cacher
+}
+
+func (c *contextCacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(key)
+}
+
+func (c *contextCacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.GetWithTTL(key)
+}
+
+func (c *contextCacher) SetCtx(ctx context.Context, key string, payload []byte, ttl int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, payload, ttl)
+}
+
+func (c *contextCacher) DelCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Del(key)
+}
+
+func (c *contextCacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.BGet(key)
+}
+
+func (c *contextCacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.BGetWithTTL(key)
+}
+
+func (c *contextCacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttl int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BSet(key, payload, ttl)
+}
+
+func (c *contextCacher) BDelCtx(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BDel(key)
+}
+
+func (c *contextCacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGet(keys)
+}
+
+func (c *contextCacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGetWithTTL(keys)
+}
+
+func (c *contextCacher) MSetCtx(ctx context.Context, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MSet(items)
+}
+
+func (c *contextCacher) MDelCtx(ctx context.Context, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MDel(keys)
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// chainKey keeps the key in the form it was passed to the chain, so string and []byte methods
+// of the chain share one implementation and still call the same-typed methods of the cachers
+type chainKey struct {
+	s     string
+	b     []byte
+	bytes bool
+}
+
+func stringKey(key string) chainKey {
+	return chainKey{s: key}
+}
+
+func bytesKey(key []byte) chainKey {
+	return chainKey{b: key, bytes: true}
+}
+
+func (k chainKey) String() string {
+	if k.bytes {
+		return string(k.b)
+	}
+	return k.s
+}
+
+func (k chainKey) get(ctx context.Context, c ContextCacher) ([]byte, error) {
+	if k.bytes {
+		return c.BGetCtx(ctx, k.b)
+	}
+	return c.GetCtx(ctx, k.s)
+}
+
+func (k chainKey) getWithTTL(ctx context.Context, c ContextCacher) ([]byte, int, error) {
+	if k.bytes {
+		return c.BGetWithTTLCtx(ctx, k.b)
+	}
+	return c.GetWithTTLCtx(ctx, k.s)
+}
+
+func (k chainKey) set(ctx context.Context, c ContextCacher, payload []byte, ttl int) error {
+	if k.bytes {
+		return c.BSetCtx(ctx, k.b, payload, ttl)
+	}
+	return c.SetCtx(ctx, k.s, payload, ttl)
+}
+
+func (k chainKey) del(ctx context.Context, c ContextCacher) error {
+	if k.bytes {
+		return c.BDelCtx(ctx, k.b)
+	}
+	return c.DelCtx(ctx, k.s)
+}
+
 // ------------------------------------------------------------------------------------------------
 
 type ChainCache struct {
-	chain []Cacher
+	// 64-bit counters go first to be aligned for atomics on 32-bit platforms
+	hits               uint64
+	misses             uint64
+	negativeHits       uint64
+	negativeBackfills  uint64
+	staleHits          uint64
+	refreshes          uint64
+	refreshErrors      uint64
+	earlyRefreshes     uint64
+	invalidations      uint64
+	tagMisses          uint64
+	writeBehindDropped uint64
+	writeBehindFailed  uint64
+
+	chain []ContextCacher
 	// Auto store found data to all cachers to the left side with the rest of data TTL, default=false
 	NoBackwardCache bool
 
 	// All internal errors will be interpreted as ErrMiss
 	IgnoreErrors bool
 
-	inited bool
-	hits   uint32
-	misses uint32
+	// Stale-while-revalidate and refresh-ahead settings, nil disables the mode
+	Revalidation *Revalidation
+
+	// Probabilistic early expiration settings of GetXFetch, nil means defaults
+	XFetch *XFetch
+
+	// Observer of chain events, nil disables notifications
+	Observer Observer
+
+	// TTL of tag versions stored by SetWithTags and InvalidateTag in the last level, default=DEFAULT_TAG_TTL.
+	// Tagged entries outliving the version of their tag turn into misses
+	TagTTL int
+
+	// Key prefixes which InvalidatePrefix can drop. Values of keys starting with one of them are stamped
+	// with the version of the prefix like with a tag, so every write of such a key costs a MGet of versions
+	GroupPrefixes []string
+
+	// Spreads TTL passed to SetTTL over the levels, nil uses the same TTL for every level
+	TTLPolicy TTLPolicy
+
+	// Shifts TTLs of every level on Set and backfill TTLs of BackfillPolicy, nil disables. Cachers of the levels
+	// may have their own Jitter, the shifts add up
+	Jitter *Jitter
+
+	// Backfill policies of the levels in order of the chain, levels without one get BACKFILL_REMAINING
+	Backfill []BackfillPolicy
+
+	// Backfill earlier levels in background, so lookups are not blocked on the writes. Close waits for them
+	AsyncBackfill bool
+
+	// Tracer of chain operations, every operation gets a span with child spans per level, nil disables tracing
+	Tracer trace.Tracer
+
+	inited       bool
+	levels       []levelStats
+	loads        singleflight.Group
+	invalidation *invalidation
+	backfills    sync.WaitGroup
+	refreshing   sync.WaitGroup
+	// closing is guarded by refreshMu, refreshes are not started once Close waits for them
+	refreshMu   sync.Mutex
+	closing     bool
+	writeBehind *writeBehind
 }
 
 func NewChainCache(cachers ...Cacher) (*ChainCache, error) {
 	c := &ChainCache{
-		chain: cachers,
+		chain: make([]ContextCacher, 0, len(cachers)),
+	}
+	for _, cacher := range cachers {
+		c.chain = append(c.chain, AsContextCacher(cacher))
 	}
-	atomic.StoreUint32(&c.hits, 0)
-	atomic.StoreUint32(&c.misses, 0)
 	err := c.Init()
 	if err != nil {
 		return nil, err
@@ -68,95 +315,162 @@ func (c *ChainCache) Init() error {
 			return err
 		}
 	}
+	c.levels = make([]levelStats, len(c.chain))
+	c.refreshMu.Lock()
+	c.closing = false
+	c.refreshMu.Unlock()
 	c.inited = true
 	return nil
 }
 
-func (c *ChainCache) Get(key string) ([]byte, error) {
-	var (
-		val []byte
-		ix  int
-		ttl int
-		err error
-	)
-	if !c.inited {
-		return nil, ErrNotInited
+// Level returns the cacher of the level as it has been passed to the chain, e.g. to Bump
+// a NamespacedCacher built by NewChainCacheFromConfig. Wrappers added by Collector are skipped.
+// nil if there is no such level
+func (c *ChainCache) Level(ix int) Cacher {
+	if ix < 0 || ix >= len(c.chain) {
+		return nil
 	}
-
-	for ix = 0; ix < len(c.chain); ix++ {
-		cacher := c.chain[ix]
-		if !c.NoBackwardCache {
-			val, ttl, err = cacher.GetWithTTL(key)
-		} else {
-			val, err = cacher.Get(key)
-		}
-
-		if err == nil {
-			atomic.AddUint32(&c.hits, 1)
-			break
-		}
-		if err != ErrMiss && c.IgnoreErrors {
-			err = ErrMiss
-		}
-		if err != ErrMiss {
-			return nil, err
-		}
+	var cacher Cacher = c.chain[ix]
+	if ic, ok := cacher.(*InstrumentedCacher); ok {
+		cacher = ic.next
 	}
-
-	if err == ErrMiss {
-		atomic.AddUint32(&c.misses, 1)
-		return nil, err
+	if cc, ok := cacher.(*contextCacher); ok {
+		return cc.Cacher
 	}
+	return cacher
+}
 
-	if !c.NoBackwardCache {
-		for ix -= 1; ix >= 0; ix-- {
-			cacher := c.chain[ix]
-			if err = cacher.Set(key, val, ttl); err != nil {
-				if !c.IgnoreErrors {
-					return nil, err
-				}
-			}
-		}
-	}
+func (c *ChainCache) Get(key string) ([]byte, error) {
+	return c.get(context.Background(), stringKey(key))
+}
+
+// GetCtx is Get which stops walking the chain as soon as ctx is done
+func (c *ChainCache) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	return c.get(ctx, stringKey(key))
+}
 
-	return val, nil
+// GetWithTTL returns data with the rest of its TTL in the cacher where it has been found
+func (c *ChainCache) GetWithTTL(key string) ([]byte, int, error) {
+	return c.getWithTTL(context.Background(), stringKey(key), true)
+}
+
+func (c *ChainCache) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	return c.getWithTTL(ctx, stringKey(key), true)
 }
 
 func (c *ChainCache) Set(key string, payload []byte, ttlSeconds []int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	if len(ttlSeconds) != len(c.chain) {
-		return fmt.Errorf("ttl slice size must be equal to your chain size")
-	}
-	for ix := 0; ix < len(c.chain); ix++ {
-		cacher := c.chain[ix]
-		if err := cacher.Set(key, payload, ttlSeconds[ix]); err != nil {
-			if !c.IgnoreErrors {
-				return err
-			}
-		}
-	}
-	return nil
+	return c.set(context.Background(), stringKey(key), payload, ttlSeconds)
+}
+
+func (c *ChainCache) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds []int) error {
+	return c.set(ctx, stringKey(key), payload, ttlSeconds)
+}
+
+// SetTTL is Set with the TTLs of the levels derived from ttl by TTLPolicy
+func (c *ChainCache) SetTTL(key string, payload []byte, ttl int) error {
+	return c.set(context.Background(), stringKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCache) SetTTLCtx(ctx context.Context, key string, payload []byte, ttl int) error {
+	return c.set(ctx, stringKey(key), payload, c.levelTTLs(ttl))
 }
 
 func (c *ChainCache) Del(key string) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	for _, cacher := range c.chain {
-		if err := cacher.Del(key); err != nil && err != ErrMiss {
-			if !c.IgnoreErrors {
-				return err
-			}
-		}
-	}
-	return nil
+	return c.del(context.Background(), stringKey(key))
+}
+
+func (c *ChainCache) DelCtx(ctx context.Context, key string) error {
+	return c.del(ctx, stringKey(key))
 }
 
 // ------------------------------------------------------------------------------------------------
 
 func (c *ChainCache) BGet(key []byte) ([]byte, error) {
+	return c.get(context.Background(), bytesKey(key))
+}
+
+func (c *ChainCache) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	return c.get(ctx, bytesKey(key))
+}
+
+func (c *ChainCache) BGetWithTTL(key []byte) ([]byte, int, error) {
+	return c.getWithTTL(context.Background(), bytesKey(key), true)
+}
+
+func (c *ChainCache) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	return c.getWithTTL(ctx, bytesKey(key), true)
+}
+
+func (c *ChainCache) BSet(key []byte, payload []byte, ttlSeconds []int) error {
+	return c.set(context.Background(), bytesKey(key), payload, ttlSeconds)
+}
+
+func (c *ChainCache) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds []int) error {
+	return c.set(ctx, bytesKey(key), payload, ttlSeconds)
+}
+
+func (c *ChainCache) BSetTTL(key []byte, payload []byte, ttl int) error {
+	return c.set(context.Background(), bytesKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCache) BSetTTLCtx(ctx context.Context, key []byte, payload []byte, ttl int) error {
+	return c.set(ctx, bytesKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCache) BDel(key []byte) error {
+	return c.del(context.Background(), bytesKey(key))
+}
+
+func (c *ChainCache) BDelCtx(ctx context.Context, key []byte) error {
+	return c.del(ctx, bytesKey(key))
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *ChainCache) levelTTLs(ttl int) []int {
+	if c.TTLPolicy == nil {
+		return sameTTLs(ttl, len(c.chain))
+	}
+	return c.TTLPolicy.LevelTTLs(ttl, len(c.chain))
+}
+
+func (c *ChainCache) get(ctx context.Context, key chainKey) ([]byte, error) {
+	val, _, err := c.getWithTTL(ctx, key, c.needTTL())
+	return val, err
+}
+
+// needTTL reports if a lookup must ask cachers for the rest of TTL
+func (c *ChainCache) needTTL() bool {
+	return !c.NoBackwardCache || (c.Revalidation != nil && c.Revalidation.RefreshAhead > 0)
+}
+
+// getWithTTL asks cachers for the ttl only if withTTL is set, it is required for backward caching.
+// ErrNegativeHit comes with the ttl of the tombstone, so nested chains can backfill it too
+func (c *ChainCache) getWithTTL(ctx context.Context, key chainKey, withTTL bool) ([]byte, int, error) {
+	e, ttl, err := c.lookup(ctx, key, withTTL)
+	if err != nil {
+		return nil, ttl, err
+	}
+	return e.payload, ttl, nil
+}
+
+// lookup walks the chain and returns the decoded entry of the key
+func (c *ChainCache) lookup(ctx context.Context, key chainKey, withTTL bool) (entry, int, error) {
+	if c.Tracer == nil {
+		e, ttl, _, err := c.walk(ctx, key, withTTL)
+		return e, ttl, err
+	}
+	ctx, sp := startSpan(ctx, c.Tracer, "chaincache.Get", key)
+	e, ttl, level, err := c.walk(ctx, key, withTTL)
+	sp.setInt(ATTR_HIT_LEVEL, level)
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(e.payload))
+	sp.setInt(ATTR_TTL, ttl)
+	sp.end(err)
+	return e, ttl, err
+}
+
+// walk looks the key up level by level and returns the index of the level it was found on, -1 on a miss
+func (c *ChainCache) walk(ctx context.Context, key chainKey, withTTL bool) (entry, int, int, error) {
 	var (
 		val []byte
 		ix  int
@@ -164,103 +478,239 @@ func (c *ChainCache) BGet(key []byte) ([]byte, error) {
 		err error
 	)
 	if !c.inited {
-		return nil, ErrNotInited
+		return entry{}, 0, -1, ErrNotInited
 	}
 
 	for ix = 0; ix < len(c.chain); ix++ {
 		cacher := c.chain[ix]
-		if !c.NoBackwardCache {
-			val, ttl, err = cacher.BGetWithTTL(key)
+		lctx, sp := startLevelSpan(ctx, c.Tracer, "chaincache.level.Get", ix)
+		start := time.Now()
+		if withTTL {
+			val, ttl, err = key.getWithTTL(lctx, cacher)
 		} else {
-			val, err = cacher.BGet(key)
+			val, err = key.get(lctx, cacher)
 		}
+		sp.setBool(ATTR_HIT, err == nil || err == ErrNegativeHit)
+		sp.end(err)
 
 		if err == nil {
-			atomic.AddUint32(&c.hits, 1)
+			// an entry of an invalidated tag is a miss of the level, deeper levels may have a fresh one
+			valid, tagErr := c.checkTags(ctx, val)
+			if tagErr != nil {
+				c.levels[ix].lookup(start, 0, 0)
+				return entry{}, 0, -1, tagErr
+			}
+			if !valid {
+				c.levels[ix].lookup(start, 0, 1)
+				err = ErrMiss
+				continue
+			}
+			c.levels[ix].lookup(start, 1, 0)
+			c.notifyHit(ix, key)
 			break
 		}
-		if err != ErrMiss && c.IgnoreErrors {
-			err = ErrMiss
+		if err == ErrNegativeHit {
+			c.levels[ix].lookup(start, 1, 0)
+			c.notifyHit(ix, key)
+			val, err = negativeEntry, nil
+			break
+		}
+		if err == ErrMiss {
+			c.levels[ix].lookup(start, 0, 1)
+			continue
 		}
-		if err != ErrMiss {
-			return nil, err
+		c.levels[ix].lookup(start, 0, 0)
+		c.notifyError(ix, "get", err)
+		// the caller has gone, there is no reason to ask the rest of the chain
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return entry{}, 0, -1, ctxErr
 		}
+		if !c.IgnoreErrors {
+			return entry{}, 0, -1, err
+		}
+		c.levels[ix].swallowed()
+		err = ErrMiss
 	}
 
 	if err == ErrMiss {
-		atomic.AddUint32(&c.misses, 1)
-		return nil, err
+		atomic.AddUint64(&c.misses, 1)
+		c.notifyMiss(key)
+		return entry{}, 0, -1, err
 	}
 
-	if !c.NoBackwardCache {
-		for ix -= 1; ix >= 0; ix-- {
-			cacher := c.chain[ix]
-			if err = cacher.BSet(key, val, ttl); err != nil {
-				if !c.IgnoreErrors {
-					return nil, err
-				}
-			}
+	e, ok := decodeEntry(val)
+	if !ok {
+		e = entry{payload: val}
+	}
+	negative := e.negative()
+	if negative {
+		atomic.AddUint64(&c.negativeHits, 1)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+		c.revalidate(key, &e, ttl)
+	}
+
+	level := ix
+	if !c.NoBackwardCache && level > 0 {
+		if err := c.backfill(ctx, key, val, ttl, level, negative); err != nil {
+			return entry{}, 0, -1, err
 		}
 	}
 
-	return val, nil
+	if negative {
+		return entry{}, ttl, level, ErrNegativeHit
+	}
+	return e, ttl, level, nil
 }
 
-func (c *ChainCache) BSet(key []byte, payload []byte, ttlSeconds []int) error {
+func (c *ChainCache) set(ctx context.Context, key chainKey, payload []byte, ttlSeconds []int) error {
+	return c.setRaw(ctx, key, c.encodePayload(payload, 0), ttlSeconds)
+}
+
+// setRaw stores data already encoded for the chain
+func (c *ChainCache) setRaw(ctx context.Context, key chainKey, data []byte, ttlSeconds []int) error {
 	if !c.inited {
 		return ErrNotInited
 	}
 	if len(ttlSeconds) != len(c.chain) {
 		return fmt.Errorf("ttl slice size must be equal to your chain size")
 	}
-	for ix := 0; ix < len(c.chain); ix++ {
+	ctx, sp := startSpan(ctx, c.Tracer, "chaincache.Set", key)
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(data))
+	data, err := c.stampGroups(ctx, key.String(), data)
+	if err == nil {
+		err = c.setLevels(ctx, key, data, ttlSeconds)
+	}
+	if err == nil && c.writeBehind == nil {
+		// write-behind workers publish the key once the remote levels are written
+		err = c.publish(ctx, key.String())
+	}
+	sp.end(err)
+	if err == nil {
+		c.notifySet(key)
+	}
+	return err
+}
+
+func (c *ChainCache) setLevels(ctx context.Context, key chainKey, data []byte, ttlSeconds []int) error {
+	local := c.localLevels()
+	for ix := 0; ix < local; ix++ {
 		cacher := c.chain[ix]
-		if err := cacher.BSet(key, payload, ttlSeconds[ix]); err != nil {
+		lctx, sp := startLevelSpan(ctx, c.Tracer, "chaincache.level.Set", ix)
+		ttl := c.Jitter.keyTTL(key, ttlSeconds[ix])
+		sp.setInt(ATTR_TTL, ttl)
+		err := key.set(lctx, cacher, data, ttl)
+		sp.end(err)
+		if err != nil {
+			c.notifyError(ix, "set", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			if !c.IgnoreErrors {
 				return err
 			}
+			c.levels[ix].swallowed()
 		}
 	}
+	if local < len(c.chain) {
+		return c.writeBehindSet(ctx, key, data, ttlSeconds)
+	}
 	return nil
 }
 
-func (c *ChainCache) BDel(key []byte) error {
+func (c *ChainCache) del(ctx context.Context, key chainKey) error {
 	if !c.inited {
 		return ErrNotInited
 	}
-	for _, cacher := range c.chain {
-		if err := cacher.BDel(key); err != nil && err != ErrMiss {
+	ctx, sp := startSpan(ctx, c.Tracer, "chaincache.Del", key)
+	err := c.delLevels(ctx, key)
+	if err == nil && c.writeBehind == nil {
+		err = c.publish(ctx, key.String())
+	}
+	sp.end(err)
+	if err == nil {
+		c.notifyDel(key)
+	}
+	return err
+}
+
+func (c *ChainCache) delLevels(ctx context.Context, key chainKey) error {
+	local := c.localLevels()
+	for ix, cacher := range c.chain[:local] {
+		lctx, sp := startLevelSpan(ctx, c.Tracer, "chaincache.level.Del", ix)
+		err := key.del(lctx, cacher)
+		sp.end(err)
+		if err != nil && err != ErrMiss {
+			c.notifyError(ix, "del", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			if !c.IgnoreErrors {
 				return err
 			}
+			c.levels[ix].swallowed()
 		}
 	}
+	if local < len(c.chain) {
+		return c.writeBehindDel(ctx, key)
+	}
 	return nil
 }
 
+// ------------------------------------------------------------------------------------------------
+
 func (c *ChainCache) Close() {
 	if !c.inited {
 		return
 	}
+	c.backfills.Wait()
+	c.refreshMu.Lock()
+	c.closing = true
+	c.refreshMu.Unlock()
+	c.refreshing.Wait()
+	// write-behind workers publish the flushed changes, so the bus goes after them
+	c.stopWriteBehind()
+	c.unsubscribe()
 	for _, cacher := range c.chain {
 		cacher.Close()
 	}
 	c.inited = false
 }
 
-func (c *ChainCache) ResetStatistics() {
+// Reset resets every cacher of the chain and the chain statistics
+func (c *ChainCache) Reset() {
 	if !c.inited {
 		return
 	}
 	for _, cacher := range c.chain {
 		cacher.Reset()
 	}
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.negativeHits, 0)
+	atomic.StoreUint64(&c.negativeBackfills, 0)
+	atomic.StoreUint64(&c.staleHits, 0)
+	atomic.StoreUint64(&c.refreshes, 0)
+	atomic.StoreUint64(&c.refreshErrors, 0)
+	atomic.StoreUint64(&c.earlyRefreshes, 0)
+	atomic.StoreUint64(&c.invalidations, 0)
+	atomic.StoreUint64(&c.tagMisses, 0)
+	atomic.StoreUint64(&c.writeBehindDropped, 0)
+	atomic.StoreUint64(&c.writeBehindFailed, 0)
+	for ix := range c.levels {
+		c.levels[ix].reset()
+	}
+}
+
+// Deprecated: use Reset
+func (c *ChainCache) ResetStatistics() {
+	c.Reset()
 }
 
-func (c *ChainCache) GetHits() uint32 {
-	return atomic.LoadUint32(&c.hits)
+func (c *ChainCache) GetHits() uint64 {
+	return atomic.LoadUint64(&c.hits)
 }
 
-func (c *ChainCache) GetMisses() uint32 {
-	return atomic.LoadUint32(&c.misses)
+func (c *ChainCache) GetMisses() uint64 {
+	return atomic.LoadUint64(&c.misses)
 }
@@ -0,0 +1,125 @@
+package chaincache
+
+import (
+	"context"
+	"math/rand"
+)
+
+// TTLPolicy spreads a single TTL over the levels of a chain
+type TTLPolicy interface {
+	LevelTTLs(ttl int, levels int) []int
+}
+
+// ScaleTTLPolicy multiplies the TTL by the factor of the level, levels without a factor get the TTL as is.
+// A positive TTL scaled below a second becomes 1, zero TTL of a level means no expiration
+type ScaleTTLPolicy []float64
+
+func (p ScaleTTLPolicy) LevelTTLs(ttl int, levels int) []int {
+	ttls := make([]int, levels)
+	for ix := range ttls {
+		ttls[ix] = ttl
+		if ix < len(p) {
+			ttls[ix] = int(float64(ttl) * p[ix])
+			if ttl > 0 && ttls[ix] < 1 {
+				ttls[ix] = 1
+			}
+		}
+	}
+	return ttls
+}
+
+// CapTTLPolicy limits the TTL by the cap of the level, zero cap or its absence means no limit
+type CapTTLPolicy []int
+
+func (p CapTTLPolicy) LevelTTLs(ttl int, levels int) []int {
+	ttls := make([]int, levels)
+	for ix := range ttls {
+		ttls[ix] = ttl
+		if ix < len(p) && p[ix] > 0 && (ttl == 0 || ttl > p[ix]) {
+			ttls[ix] = p[ix]
+		}
+	}
+	return ttls
+}
+
+// FixedTTLPolicy gives every level its own TTL ignoring the passed one, levels without a TTL
+// or with a zero one get the passed one
+type FixedTTLPolicy []int
+
+func (p FixedTTLPolicy) LevelTTLs(ttl int, levels int) []int {
+	ttls := make([]int, levels)
+	for ix := range ttls {
+		ttls[ix] = ttl
+		if ix < len(p) && p[ix] != 0 {
+			ttls[ix] = p[ix]
+		}
+	}
+	return ttls
+}
+
+// JitterTTLPolicy spreads TTLs given by Policy randomly by up to Percent of them in both directions,
+// so keys stored at once do not expire at once. nil Policy uses the same TTL for every level.
+// The shift is random on every write, Jitter of the chain gives the same shift to every write of a key
+type JitterTTLPolicy struct {
+	Policy  TTLPolicy
+	Percent float64
+}
+
+func (p JitterTTLPolicy) LevelTTLs(ttl int, levels int) []int {
+	ttls := sameTTLs(ttl, levels)
+	if p.Policy != nil {
+		ttls = p.Policy.LevelTTLs(ttl, levels)
+	}
+	for ix, ttl := range ttls {
+		ttls[ix] = jitterTTL(ttl, float64(ttl)*p.Percent/100, rand.Float64())
+	}
+	return ttls
+}
+
+func sameTTLs(ttl int, levels int) []int {
+	ttls := make([]int, levels)
+	for ix := range ttls {
+		ttls[ix] = ttl
+	}
+	return ttls
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// ChainCacher adapts ChainCache to the Cacher interface, so chains can be nested into each other,
+// wrapped by decorators and passed anywhere a Cacher is expected.
+// TTL passed to Set is spread over the levels by Policy, nil Policy falls back to TTLPolicy of the chain
+type ChainCacher struct {
+	*ChainCache
+	Policy TTLPolicy
+}
+
+func NewChainCacher(chain *ChainCache, policy TTLPolicy) *ChainCacher {
+	return &ChainCacher{
+		ChainCache: chain,
+		Policy:     policy,
+	}
+}
+
+func (c *ChainCacher) levelTTLs(ttl int) []int {
+	if c.Policy == nil {
+		return c.ChainCache.levelTTLs(ttl)
+	}
+	return c.Policy.LevelTTLs(ttl, len(c.chain))
+}
+
+func (c *ChainCacher) Set(key string, payload []byte, ttl int) error {
+	return c.set(context.Background(), stringKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCacher) SetCtx(ctx context.Context, key string, payload []byte, ttl int) error {
+	return c.set(ctx, stringKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCacher) BSet(key []byte, payload []byte, ttl int) error {
+	return c.set(context.Background(), bytesKey(key), payload, c.levelTTLs(ttl))
+}
+
+func (c *ChainCacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttl int) error {
+	return c.set(ctx, bytesKey(key), payload, c.levelTTLs(ttl))
+}
@@ -0,0 +1,77 @@
+package chaincache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values of TypedCache to bytes stored by cachers and back
+type Codec[V any] interface {
+	Marshal(v V) ([]byte, error)
+	Unmarshal(data []byte) (V, error)
+}
+
+// JSONCodec stores values as JSON
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Marshal(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Unmarshal(data []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec stores values in gob format, every value carries its type description,
+// so it suits big values better than small ones
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Marshal(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[V]) Unmarshal(data []byte) (V, error) {
+	var v V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtoCodec stores protobuf messages, V is a pointer to a generated message type
+type ProtoCodec[V proto.Message] struct{}
+
+func (ProtoCodec[V]) Marshal(v V) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (ProtoCodec[V]) Unmarshal(data []byte) (V, error) {
+	var zero V
+	v, ok := zero.ProtoReflect().New().Interface().(V)
+	if !ok {
+		return zero, fmt.Errorf("cannot create message of type %T", zero)
+	}
+	if err := proto.Unmarshal(data, v); err != nil {
+		return zero, err
+	}
+	return v, nil
+}
+
+// RawCodec stores []byte values as is
+type RawCodec struct{}
+
+func (RawCodec) Marshal(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (RawCodec) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
+}
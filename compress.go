@@ -0,0 +1,147 @@
+package chaincache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type CompressionAlgo uint8
+
+const (
+	COMPRESS_NONE CompressionAlgo = iota
+	COMPRESS_SNAPPY
+	COMPRESS_ZSTD
+	COMPRESS_GZIP
+)
+
+// Compressed values start with compressionMagic and the byte of the algorithm.
+// Values without the header are read as is, so data written before compression was turned on
+// is still readable. Short values and the ones which did not become shorter are stored
+// without compression
+var compressionMagic = []byte{0xCC, 0x5A}
+
+// CompressingCacher compresses payloads above MinSize bytes before passing them to the wrapped
+// cacher and decompresses them back on reads. It suits remote levels of a chain, where network
+// and storage costs matter, while local levels keep raw bytes
+type CompressingCacher struct {
+	decorator
+	Algo    CompressionAlgo
+	MinSize int
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+	gzip sync.Pool
+}
+
+func NewCompressingCacher(cacher Cacher, algo CompressionAlgo, minSize int) (*CompressingCacher, error) {
+	switch algo {
+	case COMPRESS_NONE, COMPRESS_SNAPPY, COMPRESS_ZSTD, COMPRESS_GZIP:
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %d", algo)
+	}
+
+	c := &CompressingCacher{
+		Algo:    algo,
+		MinSize: minSize,
+	}
+	c.decorator = newDecorator(cacher, nil, c)
+
+	var err error
+	// zstd coders are created anyway to read values written by other algorithms
+	if c.zenc, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+	if c.zdec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	c.gzip.New = func() interface{} {
+		return gzip.NewWriter(nil)
+	}
+	return c, nil
+}
+
+func (c *CompressingCacher) Close() {
+	c.decorator.Close()
+	c.zenc.Close()
+	c.zdec.Close()
+}
+
+func (c *CompressingCacher) encodePayload(_ chainKey, payload []byte) ([]byte, error) {
+	if c.Algo != COMPRESS_NONE && len(payload) >= c.MinSize {
+		compressed, err := c.compress(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			return compressed, nil
+		}
+	}
+	if bytes.HasPrefix(payload, compressionMagic) {
+		// raw payload looking like a compressed one gets the header to be read back as is
+		return append(compressionHeader(COMPRESS_NONE, len(payload)), payload...), nil
+	}
+	return payload, nil
+}
+
+func (c *CompressingCacher) compress(payload []byte) ([]byte, error) {
+	header := len(compressionMagic) + 1
+	switch c.Algo {
+	case COMPRESS_SNAPPY:
+		buf := compressionHeader(COMPRESS_SNAPPY, snappy.MaxEncodedLen(len(payload)))
+		n := len(snappy.Encode(buf[header:cap(buf)], payload))
+		return buf[:header+n], nil
+	case COMPRESS_ZSTD:
+		buf := compressionHeader(COMPRESS_ZSTD, len(payload)/2)
+		return c.zenc.EncodeAll(payload, buf), nil
+	case COMPRESS_GZIP:
+		buf := bytes.NewBuffer(compressionHeader(COMPRESS_GZIP, len(payload)/2))
+		w := c.gzip.Get().(*gzip.Writer)
+		defer c.gzip.Put(w)
+		w.Reset(buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", c.Algo)
+}
+
+func (c *CompressingCacher) decodePayload(_ chainKey, data []byte) ([]byte, error) {
+	header := len(compressionMagic) + 1
+	if len(data) < header || !bytes.HasPrefix(data, compressionMagic) {
+		return data, nil
+	}
+	algo := CompressionAlgo(data[len(compressionMagic)])
+	body := data[header:]
+	switch algo {
+	case COMPRESS_NONE:
+		return body, nil
+	case COMPRESS_SNAPPY:
+		return snappy.Decode(nil, body)
+	case COMPRESS_ZSTD:
+		return c.zdec.DecodeAll(body, nil)
+	case COMPRESS_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d of cached value", algo)
+}
+
+// compressionHeader returns the header in a slice with capacity for extra bytes of the body
+func compressionHeader(algo CompressionAlgo, extra int) []byte {
+	buf := make([]byte, 0, len(compressionMagic)+1+extra)
+	buf = append(buf, compressionMagic...)
+	return append(buf, byte(algo))
+}
@@ -0,0 +1,312 @@
+package chaincache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type FastcacheCfg struct {
+	MaxSize       int  `yaml:"max_size" json:"max_size"`
+	UseTTL        bool `yaml:"use_ttl" json:"use_ttl"`
+	WaitBigValues bool `yaml:"wait_big_values" json:"wait_big_values"`
+}
+
+type FreecacheCfg struct {
+	MaxSize int `yaml:"max_size" json:"max_size"`
+}
+
+type ProbecacheCfg struct {
+	Shards      int `yaml:"shards" json:"shards"`
+	MaxSize     int `yaml:"max_size" json:"max_size"`
+	MaxCritSize int `yaml:"max_crit_size" json:"max_crit_size"`
+	MaxDepth    int `yaml:"max_depth" json:"max_depth"`
+	// lru or lfu, default=lru
+	Strategy string `yaml:"strategy" json:"strategy"`
+}
+
+type CompressionCfg struct {
+	// snappy, zstd or gzip
+	Algo    string `yaml:"algo" json:"algo"`
+	MinSize int    `yaml:"min_size" json:"min_size"`
+}
+
+type NamespaceCfg struct {
+	Name              string `yaml:"name" json:"name"`
+	RefreshIntervalMs int64  `yaml:"refresh_interval_ms" json:"refresh_interval_ms"`
+	GenerationTTL     int    `yaml:"generation_ttl" json:"generation_ttl"`
+}
+
+type BackfillCfg struct {
+	// remaining, cap, fixed or skip, default=remaining
+	Mode string `yaml:"mode" json:"mode"`
+	TTL  int    `yaml:"ttl" json:"ttl"`
+}
+
+type WriteBehindCfg struct {
+	LocalLevels int `yaml:"local_levels" json:"local_levels"`
+	Workers     int `yaml:"workers" json:"workers"`
+	QueueSize   int `yaml:"queue_size" json:"queue_size"`
+	// block, drop or oldest, default=block
+	Backpressure string `yaml:"backpressure" json:"backpressure"`
+	Retries      int    `yaml:"retries" json:"retries"`
+	RetryDelayMs int64  `yaml:"retry_delay_ms" json:"retry_delay_ms"`
+}
+
+// LevelConfig describes a level of a chain: the type of the cacher with its settings
+// and optional decorators. Only the settings of the type are used
+type LevelConfig struct {
+	// fastcache, freecache, probecache, redis, aerospike or a type registered by RegisterCacherFactory
+	Type string `yaml:"type" json:"type"`
+	// default TTL of the level in seconds, non-zero TTLs make FixedTTLPolicy of the chain,
+	// levels without one get the TTL passed to SetTTL
+	TTL int `yaml:"ttl" json:"ttl"`
+
+	Fastcache  *FastcacheCfg   `yaml:"fastcache" json:"fastcache"`
+	Freecache  *FreecacheCfg   `yaml:"freecache" json:"freecache"`
+	Probecache *ProbecacheCfg  `yaml:"probecache" json:"probecache"`
+	Redis      *RediscacherCfg `yaml:"redis" json:"redis"`
+	Aerospike  *AerocacherCfg  `yaml:"aerospike" json:"aerospike"`
+	// settings of registered types
+	Params map[string]interface{} `yaml:"params" json:"params"`
+
+	// the cacher is wrapped by CompressingCacher
+	Compression *CompressionCfg `yaml:"compression" json:"compression"`
+	// the cacher is wrapped by NamespacedCacher, outside of compression
+	Namespace *NamespaceCfg `yaml:"namespace" json:"namespace"`
+	// backfill policy of the level
+	Backfill *BackfillCfg `yaml:"backfill" json:"backfill"`
+}
+
+// ChainConfig describes a chain, levels are in order of the chain
+type ChainConfig struct {
+	Levels          []LevelConfig `yaml:"levels" json:"levels"`
+	NoBackwardCache bool          `yaml:"no_backward_cache" json:"no_backward_cache"`
+	IgnoreErrors    bool          `yaml:"ignore_errors" json:"ignore_errors"`
+	Jitter          *Jitter       `yaml:"jitter" json:"jitter"`
+	AsyncBackfill   bool          `yaml:"async_backfill" json:"async_backfill"`
+	// remote levels are written in background
+	WriteBehind *WriteBehindCfg `yaml:"write_behind" json:"write_behind"`
+}
+
+// LevelTTLs returns default TTLs of the levels to pass to Set
+func (cfg *ChainConfig) LevelTTLs() []int {
+	ttls := make([]int, len(cfg.Levels))
+	for ix, level := range cfg.Levels {
+		ttls[ix] = level.TTL
+	}
+	return ttls
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// CacherFactory creates a cacher of a level by its config
+type CacherFactory func(cfg *LevelConfig) (Cacher, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]CacherFactory{
+		"fastcache":  newFastcacheLevel,
+		"freecache":  newFreecacheLevel,
+		"probecache": newProbecacheLevel,
+		"redis":      newRedisLevel,
+		"aerospike":  newAerospikeLevel,
+	}
+)
+
+// RegisterCacherFactory makes the type of cachers available to NewChainCacheFromConfig,
+// the factory gets its settings from Params of the level
+func RegisterCacherFactory(name string, factory CacherFactory) error {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, exists := factories[name]; exists {
+		return fmt.Errorf("cacher type %q is already registered", name)
+	}
+	factories[name] = factory
+	return nil
+}
+
+// NewChainCacheFromConfig creates cachers of the levels and joins them into a chain,
+// cachers created before a failure are closed
+func NewChainCacheFromConfig(cfg *ChainConfig) (*ChainCache, error) {
+	cachers := make([]Cacher, 0, len(cfg.Levels))
+	backfill := make([]BackfillPolicy, len(cfg.Levels))
+	fail := func(err error) (*ChainCache, error) {
+		for _, cacher := range cachers {
+			cacher.Close()
+		}
+		return nil, err
+	}
+	for ix := range cfg.Levels {
+		policy, err := backfillPolicy(cfg.Levels[ix].Backfill)
+		if err != nil {
+			return fail(fmt.Errorf("level %d (%s): %s", ix, cfg.Levels[ix].Type, err))
+		}
+		backfill[ix] = policy
+		cacher, err := newLevel(&cfg.Levels[ix])
+		if err != nil {
+			return fail(fmt.Errorf("level %d (%s): %s", ix, cfg.Levels[ix].Type, err))
+		}
+		cachers = append(cachers, cacher)
+	}
+	chain, err := NewChainCache(cachers...)
+	if err != nil {
+		return fail(err)
+	}
+	chain.NoBackwardCache = cfg.NoBackwardCache
+	chain.IgnoreErrors = cfg.IgnoreErrors
+	chain.Jitter = cfg.Jitter
+	chain.Backfill = backfill
+	chain.AsyncBackfill = cfg.AsyncBackfill
+	if wb := cfg.WriteBehind; wb != nil {
+		backpressure, err := backpressurePolicy(wb.Backpressure)
+		if err == nil {
+			err = chain.EnableWriteBehind(WriteBehind{
+				LocalLevels:  wb.LocalLevels,
+				Workers:      wb.Workers,
+				QueueSize:    wb.QueueSize,
+				Backpressure: backpressure,
+				Retries:      wb.Retries,
+				RetryDelay:   time.Duration(wb.RetryDelayMs) * time.Millisecond,
+			})
+		}
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("write-behind: %s", err)
+		}
+	}
+	for _, level := range cfg.Levels {
+		if level.TTL != 0 {
+			chain.TTLPolicy = FixedTTLPolicy(cfg.LevelTTLs())
+			break
+		}
+	}
+	return chain, nil
+}
+
+func newLevel(cfg *LevelConfig) (Cacher, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown cacher type %q", cfg.Type)
+	}
+	cacher, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Compression != nil {
+		algo, err := compressionAlgo(cfg.Compression.Algo)
+		if err != nil {
+			cacher.Close()
+			return nil, err
+		}
+		compressed, err := NewCompressingCacher(cacher, algo, cfg.Compression.MinSize)
+		if err != nil {
+			cacher.Close()
+			return nil, err
+		}
+		cacher = compressed
+	}
+	if ns := cfg.Namespace; ns != nil {
+		interval := time.Duration(ns.RefreshIntervalMs) * time.Millisecond
+		namespaced, err := NewNamespacedCacher(cacher, ns.Name, interval)
+		if err != nil {
+			cacher.Close()
+			return nil, err
+		}
+		namespaced.GenerationTTL = ns.GenerationTTL
+		cacher = namespaced
+	}
+	return cacher, nil
+}
+
+func backfillPolicy(cfg *BackfillCfg) (BackfillPolicy, error) {
+	if cfg == nil {
+		return BackfillPolicy{}, nil
+	}
+	policy := BackfillPolicy{TTL: cfg.TTL}
+	switch cfg.Mode {
+	case "", "remaining":
+		policy.Mode = BACKFILL_REMAINING
+	case "cap":
+		policy.Mode = BACKFILL_CAP
+	case "fixed":
+		policy.Mode = BACKFILL_FIXED
+	case "skip":
+		policy.Mode = BACKFILL_SKIP
+	default:
+		return policy, fmt.Errorf("unknown backfill mode %q", cfg.Mode)
+	}
+	return policy, nil
+}
+
+func backpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch name {
+	case "", "block":
+		return BACKPRESSURE_BLOCK, nil
+	case "drop":
+		return BACKPRESSURE_DROP, nil
+	case "oldest":
+		return BACKPRESSURE_DROP_OLDEST, nil
+	}
+	return BACKPRESSURE_BLOCK, fmt.Errorf("unknown backpressure policy %q", name)
+}
+
+func compressionAlgo(name string) (CompressionAlgo, error) {
+	switch name {
+	case "snappy":
+		return COMPRESS_SNAPPY, nil
+	case "zstd":
+		return COMPRESS_ZSTD, nil
+	case "gzip":
+		return COMPRESS_GZIP, nil
+	case "", "none":
+		return COMPRESS_NONE, nil
+	}
+	return COMPRESS_NONE, fmt.Errorf("unknown compression algorithm %q", name)
+}
+
+func newFastcacheLevel(cfg *LevelConfig) (Cacher, error) {
+	if cfg.Fastcache == nil {
+		return nil, fmt.Errorf("fastcache settings are missing")
+	}
+	return NewFastCacher(cfg.Fastcache.MaxSize, cfg.Fastcache.UseTTL, cfg.Fastcache.WaitBigValues)
+}
+
+func newFreecacheLevel(cfg *LevelConfig) (Cacher, error) {
+	if cfg.Freecache == nil {
+		return nil, fmt.Errorf("freecache settings are missing")
+	}
+	return NewFreeCacher(cfg.Freecache.MaxSize)
+}
+
+func newProbecacheLevel(cfg *LevelConfig) (Cacher, error) {
+	pc := cfg.Probecache
+	if pc == nil {
+		return nil, fmt.Errorf("probecache settings are missing")
+	}
+	strategy := STORAGE_LRU
+	switch pc.Strategy {
+	case "", "lru":
+	case "lfu":
+		strategy = STORAGE_LFU
+	default:
+		return nil, fmt.Errorf("unknown probecache strategy %q", pc.Strategy)
+	}
+	return NewProbecacher(pc.Shards, pc.MaxSize, pc.MaxCritSize, pc.MaxDepth, strategy)
+}
+
+func newRedisLevel(cfg *LevelConfig) (Cacher, error) {
+	if cfg.Redis == nil {
+		return nil, fmt.Errorf("redis settings are missing")
+	}
+	return NewRediscacher(cfg.Redis)
+}
+
+func newAerospikeLevel(cfg *LevelConfig) (Cacher, error) {
+	if cfg.Aerospike == nil {
+		return nil, fmt.Errorf("aerospike settings are missing")
+	}
+	return NewAerocacher(cfg.Aerospike)
+}
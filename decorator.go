@@ -0,0 +1,379 @@
+package chaincache
+
+import (
+	"context"
+	"time"
+)
+
+// keyTransform changes keys before passing them to the wrapped cacher,
+// string keys must stay string ones and []byte keys - []byte ones
+type keyTransform interface {
+	transformKey(key chainKey) chainKey
+}
+
+// payloadTransform changes payloads on their way to the wrapped cacher and back,
+// key is the key passed to the decorator. decodePayload returns ErrMiss if the value
+// does not belong to the key
+type payloadTransform interface {
+	encodePayload(key chainKey, payload []byte) ([]byte, error)
+	decodePayload(key chainKey, data []byte) ([]byte, error)
+}
+
+// opObserver is told about every operation passed through a decorator: its name (get, set,
+// del, mget, mset, mdel), duration, number of found and missed keys and the error if it failed
+type opObserver interface {
+	observeOp(op string, elapsed time.Duration, hits int, misses int, err error)
+}
+
+// keyObserver is told about every key successfully passed through a decorator by get, set
+// and del operations including batch ones, err is ErrMiss for missed keys
+type keyObserver interface {
+	observeKey(op string, key chainKey, err error)
+}
+
+// decorator is the base of cachers wrapping another one, it passes every operation
+// to the wrapped cacher transforming keys and payloads, nil transforms keep them as is
+type decorator struct {
+	next     ContextCacher
+	keys     keyTransform
+	payloads payloadTransform
+	observer opObserver
+	watcher  keyObserver
+}
+
+func newDecorator(cacher Cacher, keys keyTransform, payloads payloadTransform) decorator {
+	return decorator{
+		next:     AsContextCacher(cacher),
+		keys:     keys,
+		payloads: payloads,
+	}
+}
+
+// Unwrap returns the wrapped cacher
+func (d *decorator) Unwrap() Cacher {
+	return d.next
+}
+
+func (d *decorator) Init() error {
+	return d.next.Init()
+}
+
+func (d *decorator) Reset() {
+	d.next.Reset()
+}
+
+func (d *decorator) Close() {
+	d.next.Close()
+}
+
+func (d *decorator) GetHits() uint64 {
+	return d.next.GetHits()
+}
+
+func (d *decorator) GetMisses() uint64 {
+	return d.next.GetMisses()
+}
+
+func (d *decorator) Get(key string) ([]byte, error) {
+	data, _, err := d.getWithTTL(context.Background(), stringKey(key), false)
+	return data, err
+}
+
+func (d *decorator) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := d.getWithTTL(ctx, stringKey(key), false)
+	return data, err
+}
+
+func (d *decorator) GetWithTTL(key string) ([]byte, int, error) {
+	return d.getWithTTL(context.Background(), stringKey(key), true)
+}
+
+func (d *decorator) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	return d.getWithTTL(ctx, stringKey(key), true)
+}
+
+func (d *decorator) Set(key string, payload []byte, ttl int) error {
+	return d.set(context.Background(), stringKey(key), payload, ttl)
+}
+
+func (d *decorator) SetCtx(ctx context.Context, key string, payload []byte, ttl int) error {
+	return d.set(ctx, stringKey(key), payload, ttl)
+}
+
+func (d *decorator) Del(key string) error {
+	return d.del(context.Background(), stringKey(key))
+}
+
+func (d *decorator) DelCtx(ctx context.Context, key string) error {
+	return d.del(ctx, stringKey(key))
+}
+
+func (d *decorator) BGet(key []byte) ([]byte, error) {
+	data, _, err := d.getWithTTL(context.Background(), bytesKey(key), false)
+	return data, err
+}
+
+func (d *decorator) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	data, _, err := d.getWithTTL(ctx, bytesKey(key), false)
+	return data, err
+}
+
+func (d *decorator) BGetWithTTL(key []byte) ([]byte, int, error) {
+	return d.getWithTTL(context.Background(), bytesKey(key), true)
+}
+
+func (d *decorator) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	return d.getWithTTL(ctx, bytesKey(key), true)
+}
+
+func (d *decorator) BSet(key []byte, payload []byte, ttl int) error {
+	return d.set(context.Background(), bytesKey(key), payload, ttl)
+}
+
+func (d *decorator) BSetCtx(ctx context.Context, key []byte, payload []byte, ttl int) error {
+	return d.set(ctx, bytesKey(key), payload, ttl)
+}
+
+func (d *decorator) BDel(key []byte) error {
+	return d.del(context.Background(), bytesKey(key))
+}
+
+func (d *decorator) BDelCtx(ctx context.Context, key []byte) error {
+	return d.del(ctx, bytesKey(key))
+}
+
+func (d *decorator) MGet(keys []string) ([]Item, []string, error) {
+	return d.mget(context.Background(), keys, false)
+}
+
+func (d *decorator) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return d.mget(ctx, keys, false)
+}
+
+func (d *decorator) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	return d.mget(context.Background(), keys, true)
+}
+
+func (d *decorator) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	return d.mget(ctx, keys, true)
+}
+
+func (d *decorator) MSet(items []Item) error {
+	return d.MSetCtx(context.Background(), items)
+}
+
+func (d *decorator) MSetCtx(ctx context.Context, items []Item) error {
+	return d.mset(ctx, items)
+}
+
+func (d *decorator) MDel(keys []string) error {
+	return d.mdel(context.Background(), keys)
+}
+
+func (d *decorator) MDelCtx(ctx context.Context, keys []string) error {
+	return d.mdel(ctx, keys)
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// observe reports the operation started at start, zero start means there is no observer
+func (d *decorator) observe(op string, start time.Time, hits int, misses int, err error) {
+	if d.observer != nil {
+		d.observer.observeOp(op, time.Since(start), hits, misses, err)
+	}
+}
+
+func (d *decorator) observeKey(op string, key chainKey, err error) {
+	if d.watcher != nil {
+		d.watcher.observeKey(op, key, err)
+	}
+}
+
+func (d *decorator) now() time.Time {
+	if d.observer == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (d *decorator) key(key chainKey) chainKey {
+	if d.keys == nil {
+		return key
+	}
+	return d.keys.transformKey(key)
+}
+
+func (d *decorator) mkeys(keys []string) []string {
+	if d.keys == nil {
+		return keys
+	}
+	transformed := make([]string, len(keys))
+	for ix, key := range keys {
+		transformed[ix] = d.keys.transformKey(stringKey(key)).s
+	}
+	return transformed
+}
+
+func (d *decorator) getWithTTL(ctx context.Context, key chainKey, withTTL bool) ([]byte, int, error) {
+	var (
+		data []byte
+		ttl  int
+		err  error
+	)
+	start := d.now()
+	if withTTL {
+		data, ttl, err = d.key(key).getWithTTL(ctx, d.next)
+	} else {
+		data, err = d.key(key).get(ctx, d.next)
+	}
+	// a value the transform cannot decode or finds foreign is not a hit
+	if err == nil && d.payloads != nil {
+		data, err = d.payloads.decodePayload(key, data)
+		if err != nil {
+			ttl = 0
+		}
+	}
+	switch err {
+	case nil, ErrNegativeHit:
+		d.observe("get", start, 1, 0, nil)
+		d.observeKey("get", key, nil)
+	case ErrMiss:
+		d.observe("get", start, 0, 1, nil)
+		d.observeKey("get", key, ErrMiss)
+	default:
+		d.observe("get", start, 0, 0, err)
+	}
+	if err != nil {
+		return nil, ttl, err
+	}
+	return data, ttl, nil
+}
+
+func (d *decorator) set(ctx context.Context, key chainKey, payload []byte, ttl int) error {
+	if d.payloads != nil {
+		data, err := d.payloads.encodePayload(key, payload)
+		if err != nil {
+			return err
+		}
+		payload = data
+	}
+	start := d.now()
+	err := d.key(key).set(ctx, d.next, payload, ttl)
+	d.observe("set", start, 0, 0, err)
+	if err == nil {
+		d.observeKey("set", key, nil)
+	}
+	return err
+}
+
+func (d *decorator) del(ctx context.Context, key chainKey) error {
+	start := d.now()
+	err := d.key(key).del(ctx, d.next)
+	if err == nil || err == ErrMiss {
+		d.observe("del", start, 0, 0, nil)
+		d.observeKey("del", key, nil)
+	} else {
+		d.observe("del", start, 0, 0, err)
+	}
+	return err
+}
+
+func (d *decorator) mset(ctx context.Context, items []Item) error {
+	encoded := make([]Item, len(items))
+	for ix, item := range items {
+		key := stringKey(item.Key)
+		if d.payloads != nil {
+			data, err := d.payloads.encodePayload(key, item.Value)
+			if err != nil {
+				return err
+			}
+			item.Value = data
+		}
+		item.Key = d.key(key).s
+		encoded[ix] = item
+	}
+	start := d.now()
+	err := d.next.MSetCtx(ctx, encoded)
+	d.observe("mset", start, 0, 0, err)
+	if err == nil && d.watcher != nil {
+		for _, item := range items {
+			d.watcher.observeKey("set", stringKey(item.Key), nil)
+		}
+	}
+	return err
+}
+
+func (d *decorator) mdel(ctx context.Context, keys []string) error {
+	start := d.now()
+	err := d.next.MDelCtx(ctx, d.mkeys(keys))
+	d.observe("mdel", start, 0, 0, err)
+	if err == nil && d.watcher != nil {
+		for _, key := range keys {
+			d.watcher.observeKey("del", stringKey(key), nil)
+		}
+	}
+	return err
+}
+
+// mget asks the wrapped cacher by transformed keys and returns items and misses with original ones
+func (d *decorator) mget(ctx context.Context, keys []string, withTTL bool) ([]Item, []string, error) {
+	transformed := d.mkeys(keys)
+	var (
+		items  []Item
+		misses []string
+		err    error
+	)
+	start := d.now()
+	if withTTL {
+		items, misses, err = d.next.MGetWithTTLCtx(ctx, transformed)
+	} else {
+		items, misses, err = d.next.MGetCtx(ctx, transformed)
+	}
+	if err != nil {
+		d.observe("mget", start, 0, 0, err)
+		return nil, nil, err
+	}
+
+	var original map[string]string
+	if d.keys != nil {
+		original = make(map[string]string, len(keys))
+		for ix, key := range transformed {
+			original[key] = keys[ix]
+		}
+		for ix := range misses {
+			misses[ix] = original[misses[ix]]
+		}
+	}
+	found := items[:0]
+	for _, item := range items {
+		if original != nil {
+			item.Key = original[item.Key]
+		}
+		// a tombstone of a nested chain has no payload to decode, Get passes it as ErrNegativeHit
+		if d.payloads != nil && !item.Negative {
+			payload, err := d.payloads.decodePayload(stringKey(item.Key), item.Value)
+			// the transform may find out the value does not belong to the key
+			if err == ErrMiss {
+				misses = append(misses, item.Key)
+				continue
+			}
+			if err != nil {
+				d.observe("mget", start, 0, 0, err)
+				return nil, nil, err
+			}
+			item.Value = payload
+		}
+		found = append(found, item)
+	}
+	items = found
+	d.observe("mget", start, len(items), len(misses), nil)
+	if d.watcher != nil {
+		for _, item := range items {
+			d.watcher.observeKey("get", stringKey(item.Key), nil)
+		}
+		for _, key := range misses {
+			d.watcher.observeKey("get", stringKey(key), ErrMiss)
+		}
+	}
+	return items, misses, nil
+}
@@ -0,0 +1,134 @@
+package chaincache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// Encrypted values start with encryptionMagic, ID of the key, nonce and then AES-GCM sealed payload
+var encryptionMagic = []byte{0xCC, 0xE5}
+
+var ErrDecrypt = fmt.Errorf("cannot decrypt cached value")
+
+// EncryptionKey is an AES key of 16, 24 or 32 bytes, ID is stored with every value encrypted by it
+type EncryptionKey struct {
+	ID  uint32
+	Key []byte
+}
+
+// EncryptingCacher encrypts payloads by AES-GCM before passing them to the wrapped cacher.
+// Values are encrypted by the current key and decrypted by any known one, so keys can rotate
+// while old values live out their TTL. The key of the value is authenticated with the payload,
+// so a value copied under another key is not decryptable. Values which fail authentication
+// are reported as ErrDecrypt. Plain values and values of keys no longer configured are misses,
+// so a chain falls through to the next level and overwrites them
+type EncryptingCacher struct {
+	decorator
+
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+
+	hashSecret []byte
+	hashes     sync.Pool
+}
+
+func NewEncryptingCacher(cacher Cacher, current EncryptionKey, old ...EncryptionKey) (*EncryptingCacher, error) {
+	c := &EncryptingCacher{
+		current: current.ID,
+		aeads:   make(map[uint32]cipher.AEAD, len(old)+1),
+	}
+	for _, key := range append([]EncryptionKey{current}, old...) {
+		if _, ok := c.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("NewEncryptingCacher: duplicated key id %d", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("NewEncryptingCacher: key %d: %s", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("NewEncryptingCacher: key %d: %s", key.ID, err)
+		}
+		c.aeads[key.ID] = aead
+	}
+	c.decorator = newDecorator(cacher, nil, c)
+	return c, nil
+}
+
+// HashKeys turns on HMAC-SHA256 hashing of keys by secret, so raw identifiers never reach
+// the wrapped cacher. Must be called before the cacher is used
+func (c *EncryptingCacher) HashKeys(secret []byte) {
+	c.hashSecret = secret
+	c.hashes.New = func() interface{} {
+		return hmac.New(sha256.New, c.hashSecret)
+	}
+	c.decorator.keys = c
+}
+
+func (c *EncryptingCacher) transformKey(key chainKey) chainKey {
+	h := c.hashes.Get().(hash.Hash)
+	defer c.hashes.Put(h)
+	h.Reset()
+	if key.bytes {
+		h.Write(key.b)
+	} else {
+		h.Write([]byte(key.s))
+	}
+	var sum [sha256.Size]byte
+	hashed := make([]byte, base64.RawURLEncoding.EncodedLen(sha256.Size))
+	base64.RawURLEncoding.Encode(hashed, h.Sum(sum[:0]))
+	if key.bytes {
+		return bytesKey(hashed)
+	}
+	return stringKey(string(hashed))
+}
+
+func (c *EncryptingCacher) encodePayload(key chainKey, payload []byte) ([]byte, error) {
+	aead := c.aeads[c.current]
+	header := len(encryptionMagic) + 4
+	buf := make([]byte, header+aead.NonceSize(), header+aead.NonceSize()+len(payload)+aead.Overhead())
+	copy(buf, encryptionMagic)
+	binary.BigEndian.PutUint32(buf[len(encryptionMagic):], c.current)
+	nonce := buf[header:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, nonce, payload, keyBytes(key)), nil
+}
+
+func (c *EncryptingCacher) decodePayload(key chainKey, data []byte) ([]byte, error) {
+	header := len(encryptionMagic) + 4
+	if len(data) < header || !bytes.HasPrefix(data, encryptionMagic) {
+		return nil, ErrMiss
+	}
+	aead, ok := c.aeads[binary.BigEndian.Uint32(data[len(encryptionMagic):])]
+	if !ok {
+		// the key is rotated out, the value is as good as expired
+		return nil, ErrMiss
+	}
+	if len(data) < header+aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	payload, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], keyBytes(key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return payload, nil
+}
+
+func keyBytes(key chainKey) []byte {
+	if key.bytes {
+		return key.b
+	}
+	return []byte(key.s)
+}
@@ -0,0 +1,161 @@
+package chaincache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Values the chain writes for its own needs (tombstones of negative caching, soft expiration, ...)
+// start with a header: entryMagic, a byte of flags, fields required by the flags in order of the flag bits.
+// The payload follows the header. Values without entryMagic are plain payloads written as is
+var entryMagic = []byte{0xCC, 0xE7, 0x01}
+
+const (
+	// the key is cached as not existing, entry has no payload
+	entryNegative uint8 = 1 << iota
+	// 8 bytes of unix time when the entry becomes stale
+	entrySoftExpiry
+	// 4 bytes of milliseconds the value took to compute, used by XFetch
+	entryCost
+	// 2 bytes of the number of tags, every tag is 2 bytes of its length, the name and 8 bytes of its version
+	entryTags
+)
+
+type entry struct {
+	flags      uint8
+	softExpiry int64
+	cost       time.Duration
+	tags       []entryTag
+	payload    []byte
+}
+
+// entryTag is a tag with its version at the moment the entry was stored
+type entryTag struct {
+	name    string
+	version uint64
+}
+
+func (e *entry) negative() bool {
+	return e.flags&entryNegative != 0
+}
+
+// stale reports if soft expiration of the entry has passed
+func (e *entry) stale(now int64) bool {
+	return e.flags&entrySoftExpiry != 0 && now >= e.softExpiry
+}
+
+func (e *entry) encode() []byte {
+	size := len(entryMagic) + 1 + len(e.payload)
+	if e.flags&entrySoftExpiry != 0 {
+		size += 8
+	}
+	if e.flags&entryCost != 0 {
+		size += 4
+	}
+	if e.flags&entryTags != 0 {
+		size += 2
+		for _, tag := range e.tags {
+			size += 2 + len(tag.name) + 8
+		}
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, entryMagic...)
+	buf = append(buf, e.flags)
+	if e.flags&entrySoftExpiry != 0 {
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(e.softExpiry))
+		buf = append(buf, ts[:]...)
+	}
+	if e.flags&entryCost != 0 {
+		var ms [4]byte
+		binary.BigEndian.PutUint32(ms[:], uint32(e.cost/time.Millisecond))
+		buf = append(buf, ms[:]...)
+	}
+	if e.flags&entryTags != 0 {
+		var num [8]byte
+		binary.BigEndian.PutUint16(num[:2], uint16(len(e.tags)))
+		buf = append(buf, num[:2]...)
+		for _, tag := range e.tags {
+			binary.BigEndian.PutUint16(num[:2], uint16(len(tag.name)))
+			buf = append(append(buf, num[:2]...), tag.name...)
+			binary.BigEndian.PutUint64(num[:], tag.version)
+			buf = append(buf, num[:]...)
+		}
+	}
+	return append(buf, e.payload...)
+}
+
+// decodeEntry returns false if data is a plain payload
+func decodeEntry(data []byte) (entry, bool) {
+	if len(data) < len(entryMagic)+1 || !bytes.HasPrefix(data, entryMagic) {
+		return entry{}, false
+	}
+	e := entry{flags: data[len(entryMagic)]}
+	data = data[len(entryMagic)+1:]
+	if e.flags&entrySoftExpiry != 0 {
+		if len(data) < 8 {
+			return entry{}, false
+		}
+		e.softExpiry = int64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	if e.flags&entryCost != 0 {
+		if len(data) < 4 {
+			return entry{}, false
+		}
+		e.cost = time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond
+		data = data[4:]
+	}
+	if e.flags&entryTags != 0 {
+		if len(data) < 2 {
+			return entry{}, false
+		}
+		e.tags = make([]entryTag, binary.BigEndian.Uint16(data))
+		data = data[2:]
+		for ix := range e.tags {
+			if len(data) < 2 {
+				return entry{}, false
+			}
+			size := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+size+8 {
+				return entry{}, false
+			}
+			e.tags[ix].name = string(data[2 : 2+size])
+			e.tags[ix].version = binary.BigEndian.Uint64(data[2+size:])
+			data = data[2+size+8:]
+		}
+	}
+	e.payload = data
+	return e, true
+}
+
+var negativeEntry = (&entry{flags: entryNegative}).encode()
+
+// encodePayload adds the header required by the enabled features of the chain to the payload,
+// non-zero cost is the time the payload took to compute.
+// Plain payloads looking like an entry are wrapped too, so they are never mistaken for one
+func (c *ChainCache) encodePayload(payload []byte, cost time.Duration) []byte {
+	return c.encodeTagged(payload, cost, nil)
+}
+
+// encodeTagged is encodePayload stamping the entry with tags
+func (c *ChainCache) encodeTagged(payload []byte, cost time.Duration, tags []entryTag) []byte {
+	e := entry{payload: payload}
+	if c.Revalidation != nil && c.Revalidation.SoftTTL > 0 {
+		e.flags |= entrySoftExpiry
+		e.softExpiry = time.Now().Unix() + int64(c.Revalidation.SoftTTL)
+	}
+	if cost >= time.Millisecond {
+		e.flags |= entryCost
+		e.cost = cost
+	}
+	if len(tags) > 0 {
+		e.flags |= entryTags
+		e.tags = tags
+	}
+	if e.flags == 0 && !bytes.HasPrefix(payload, entryMagic) {
+		return payload
+	}
+	return e.encode()
+}
@@ -1,23 +1,26 @@
 package chaincache
 
 import (
+	"context"
 	"encoding/binary"
-	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/fastcache"
 )
 
 type Fastcacher struct {
+	cacherStats
+
 	MaxSize       int
 	UseTTL        bool
 	waitBigValues bool
 
+	// shifts TTLs of written keys, nil disables
+	Jitter *Jitter
+
 	inited       bool
 	ttlKeySuffix []byte
 	cache        *fastcache.Cache
-	hits         uint32
-	misses       uint32
 }
 
 func NewFastCacher(maxSize int, useTTL bool, waitBigValues bool) (*Fastcacher, error) {
@@ -43,8 +46,6 @@ func NewFastCacherFromInstance(cache *fastcache.Cache, useTTL bool, waitBigValue
 		waitBigValues: waitBigValues,
 		ttlKeySuffix:  []byte("@"),
 	}
-	atomic.StoreUint32(&c.hits, 0)
-	atomic.StoreUint32(&c.misses, 0)
 	return c, nil
 }
 
@@ -54,85 +55,38 @@ func (c *Fastcacher) Init() error {
 	}
 	c.inited = true
 	c.cache = fastcache.New(c.MaxSize)
-	atomic.StoreUint32(&c.hits, 0)
-	atomic.StoreUint32(&c.misses, 0)
+	c.resetStats()
 	return nil
 }
 
 func (c *Fastcacher) GetWithTTL(key string) ([]byte, int, error) {
-	if !c.inited {
-		return nil, 0, ErrNotInited
-	}
-	k := []byte(key)
-	var ret []byte
-	if c.waitBigValues {
-		ret = c.cache.GetBig(nil, k)
-	} else {
-		ret = c.cache.Get(nil, k)
-	}
-	if ret == nil {
-		atomic.AddUint32(&c.misses, 1)
-		return nil, 0, ErrMiss
-	}
-
-	if c.UseTTL {
-		ttlBytes := ret[len(ret)-8:]
-		ret := ret[:len(ret)-8]
-		ttl := int64(binary.LittleEndian.Uint64(ttlBytes)) - time.Now().Unix()
-		if ttl <= 0 {
-			atomic.AddUint32(&c.misses, 1)
-			c.cache.Del(k)
-			return nil, 0, ErrMiss
-		}
-
-		atomic.AddUint32(&c.hits, 1)
-		return ret, int(ttl), nil
-	}
-	atomic.AddUint32(&c.hits, 1)
-	return ret, 0, nil
+	return c.BGetWithTTL([]byte(key))
 }
 
 func (c *Fastcacher) Get(key string) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
-	val, _, err := c.GetWithTTL(key)
+	val, _, err := c.BGetWithTTL([]byte(key))
 	return val, err
 }
 
 func (c *Fastcacher) Set(key string, payload []byte, ttlSeconds int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-
-	if c.UseTTL {
-		tsBytes := make([]byte, 8)
-		ts := time.Now().Unix() + int64(ttlSeconds)
-		binary.LittleEndian.PutUint64(tsBytes, uint64(ts))
-		payload = append(payload, tsBytes...)
-	}
-	if c.waitBigValues {
-		c.cache.SetBig([]byte(key), payload)
-	} else {
-		c.cache.Set([]byte(key), payload)
-	}
-
-	return nil
+	return c.BSet([]byte(key), payload, ttlSeconds)
 }
 
 func (c *Fastcacher) Del(key string) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	c.cache.Del([]byte(key))
-	return nil
+	return c.BDel([]byte(key))
 }
 
 func (c *Fastcacher) BGetWithTTL(key []byte) ([]byte, int, error) {
 	if !c.inited {
 		return nil, 0, ErrNotInited
 	}
+	start := time.Now()
+	val, ttl, err := c.getWithTTL(key)
+	c.done(opGet, start, err)
+	return val, ttl, err
+}
 
+func (c *Fastcacher) getWithTTL(key []byte) ([]byte, int, error) {
 	var ret []byte
 	if c.waitBigValues {
 		ret = c.cache.GetBig(nil, key)
@@ -140,7 +94,6 @@ func (c *Fastcacher) BGetWithTTL(key []byte) ([]byte, int, error) {
 		ret = c.cache.Get(nil, key)
 	}
 	if ret == nil {
-		atomic.AddUint32(&c.misses, 1)
 		return nil, 0, ErrMiss
 	}
 
@@ -149,23 +102,15 @@ func (c *Fastcacher) BGetWithTTL(key []byte) ([]byte, int, error) {
 		ret := ret[:len(ret)-8]
 		ttl := int64(binary.LittleEndian.Uint64(ttlBytes)) - time.Now().Unix()
 		if ttl <= 0 {
-			atomic.AddUint32(&c.misses, 1)
 			c.cache.Del(key)
 			return nil, 0, ErrMiss
 		}
-
-		atomic.AddUint32(&c.hits, 1)
 		return ret, int(ttl), nil
 	}
-	atomic.AddUint32(&c.hits, 1)
-
 	return ret, 0, nil
 }
 
 func (c *Fastcacher) BGet(key []byte) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
 	val, _, err := c.BGetWithTTL(key)
 	return val, err
 }
@@ -174,8 +119,10 @@ func (c *Fastcacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
 	if !c.inited {
 		return ErrNotInited
 	}
+	start := time.Now()
 
 	if c.UseTTL {
+		ttlSeconds = c.Jitter.bytesTTL(key, ttlSeconds)
 		tsBytes := make([]byte, 8)
 		ts := time.Now().Unix() + int64(ttlSeconds)
 		binary.LittleEndian.PutUint64(tsBytes, uint64(ts))
@@ -186,6 +133,7 @@ func (c *Fastcacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
 	} else {
 		c.cache.Set(key, payload)
 	}
+	c.done(opSet, start, nil)
 	return nil
 }
 
@@ -193,7 +141,9 @@ func (c *Fastcacher) BDel(key []byte) error {
 	if !c.inited {
 		return ErrNotInited
 	}
+	start := time.Now()
 	c.cache.Del(key)
+	c.done(opDel, start, nil)
 	return nil
 }
 
@@ -206,16 +156,126 @@ func (c *Fastcacher) Close() {
 
 func (c *Fastcacher) Reset() {
 	c.cache.Reset()
-	atomic.StoreUint32(&c.hits, 0)
-	atomic.StoreUint32(&c.misses, 0)
+	c.resetStats()
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *Fastcacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(key)
+}
+
+func (c *Fastcacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.GetWithTTL(key)
+}
+
+func (c *Fastcacher) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, payload, ttlSeconds)
 }
 
-func (c *Fastcacher) GetHits() uint32 {
-	return atomic.LoadUint32(&c.hits)
+func (c *Fastcacher) DelCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Del(key)
+}
+
+func (c *Fastcacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.BGet(key)
 }
 
-func (c *Fastcacher) GetMisses() uint32 {
-	return atomic.LoadUint32(&c.misses)
+func (c *Fastcacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.BGetWithTTL(key)
+}
+
+func (c *Fastcacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BSet(key, payload, ttlSeconds)
+}
+
+func (c *Fastcacher) BDelCtx(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BDel(key)
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *Fastcacher) MGet(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, func(key string) ([]byte, int, error) {
+		val, err := c.Get(key)
+		return val, 0, err
+	})
+}
+
+func (c *Fastcacher) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, c.GetWithTTL)
+}
+
+func (c *Fastcacher) MSet(items []Item) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return msetEach(items, c.Set)
+}
+
+func (c *Fastcacher) MDel(keys []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return mdelEach(keys, c.Del)
+}
+
+func (c *Fastcacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGet(keys)
+}
+
+func (c *Fastcacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGetWithTTL(keys)
+}
+
+func (c *Fastcacher) MSetCtx(ctx context.Context, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MSet(items)
+}
+
+func (c *Fastcacher) MDelCtx(ctx context.Context, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MDel(keys)
 }
 
 // ------------------------------------------------------------------------------------------------
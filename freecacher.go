@@ -1,6 +1,7 @@
 package chaincache
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,8 +9,13 @@ import (
 )
 
 type Freecacher struct {
+	cacherStats
+
 	MaxSize int
 
+	// shifts TTLs of written keys, nil disables
+	Jitter *Jitter
+
 	inited bool
 	cache  *freecache.Cache
 }
@@ -35,55 +41,33 @@ func (c *Freecacher) Init() error {
 }
 
 func (c *Freecacher) GetWithTTL(key string) ([]byte, int, error) {
-	if !c.inited {
-		return nil, 0, ErrNotInited
-	}
-	// log.Printf("Freecache: get %s", key)
-	value, expiresAt, err := c.cache.GetWithExpiration([]byte(key))
-	if err != nil {
-		if err == freecache.ErrNotFound {
-			return nil, 0, ErrMiss
-		}
-		return nil, 0, fmt.Errorf("internal cache error: %s", err)
-	}
-	ttl := int64(expiresAt) - time.Now().Unix()
-	if ttl <= 0 {
-		return nil, 0, ErrMiss
-	}
-	return value, int(ttl), nil
+	return c.BGetWithTTL([]byte(key))
 }
 
 func (c *Freecacher) Get(key string) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
-	val, _, err := c.GetWithTTL(key)
+	val, _, err := c.BGetWithTTL([]byte(key))
 	return val, err
 }
 
 func (c *Freecacher) Set(key string, payload []byte, ttlSeconds int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	// log.Printf("Freecache: set %s", key)
-	return c.cache.Set([]byte(key), payload, ttlSeconds)
+	return c.BSet([]byte(key), payload, ttlSeconds)
 }
 
 func (c *Freecacher) Del(key string) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	affected := c.cache.Del([]byte(key))
-	if !affected {
-		return ErrMiss
-	}
-	return nil
+	return c.BDel([]byte(key))
 }
 
 func (c *Freecacher) BGetWithTTL(key []byte) ([]byte, int, error) {
 	if !c.inited {
 		return nil, 0, ErrNotInited
 	}
+	start := time.Now()
+	val, ttl, err := c.getWithTTL(key)
+	c.done(opGet, start, err)
+	return val, ttl, err
+}
+
+func (c *Freecacher) getWithTTL(key []byte) ([]byte, int, error) {
 	// log.Printf("Freecache: get %s", key)
 	value, expiresAt, err := c.cache.GetWithExpiration(key)
 	if err != nil {
@@ -100,9 +84,6 @@ func (c *Freecacher) BGetWithTTL(key []byte) ([]byte, int, error) {
 }
 
 func (c *Freecacher) BGet(key []byte) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
 	val, _, err := c.BGetWithTTL(key)
 	return val, err
 }
@@ -112,18 +93,23 @@ func (c *Freecacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
 		return ErrNotInited
 	}
 	// log.Printf("Freecache: set %s", key)
-	return c.cache.Set(key, payload, ttlSeconds)
+	start := time.Now()
+	err := c.cache.Set(key, payload, c.Jitter.bytesTTL(key, ttlSeconds))
+	c.done(opSet, start, err)
+	return err
 }
 
 func (c *Freecacher) BDel(key []byte) error {
 	if !c.inited {
 		return ErrNotInited
 	}
-	affected := c.cache.Del(key)
-	if !affected {
-		return ErrMiss
+	start := time.Now()
+	var err error
+	if !c.cache.Del(key) {
+		err = ErrMiss
 	}
-	return nil
+	c.done(opDel, start, err)
+	return err
 }
 
 func (c *Freecacher) Close() {
@@ -136,14 +122,126 @@ func (c *Freecacher) Close() {
 func (c *Freecacher) Reset() {
 	c.cache.Clear()
 	c.cache.ResetStatistics()
+	c.resetStats()
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *Freecacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(key)
 }
 
-func (c *Freecacher) GetHits() uint32 {
-	return uint32(c.cache.HitCount())
+func (c *Freecacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.GetWithTTL(key)
 }
 
-func (c *Freecacher) GetMisses() uint32 {
-	return uint32(c.cache.MissCount())
+func (c *Freecacher) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, payload, ttlSeconds)
+}
+
+func (c *Freecacher) DelCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Del(key)
+}
+
+func (c *Freecacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.BGet(key)
+}
+
+func (c *Freecacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.BGetWithTTL(key)
+}
+
+func (c *Freecacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BSet(key, payload, ttlSeconds)
+}
+
+func (c *Freecacher) BDelCtx(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BDel(key)
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *Freecacher) MGet(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, func(key string) ([]byte, int, error) {
+		val, err := c.Get(key)
+		return val, 0, err
+	})
+}
+
+func (c *Freecacher) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, c.GetWithTTL)
+}
+
+func (c *Freecacher) MSet(items []Item) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return msetEach(items, c.Set)
+}
+
+func (c *Freecacher) MDel(keys []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return mdelEach(keys, c.Del)
+}
+
+func (c *Freecacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGet(keys)
+}
+
+func (c *Freecacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGetWithTTL(keys)
+}
+
+func (c *Freecacher) MSetCtx(ctx context.Context, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MSet(items)
+}
+
+func (c *Freecacher) MDelCtx(ctx context.Context, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MDel(keys)
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -0,0 +1,265 @@
+package chaincache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// InvalidationMessage carries keys changed by a chain
+type InvalidationMessage struct {
+	// id of the publishing chain, chains skip their own messages
+	Source string
+	Keys   []string
+}
+
+// InvalidationBus delivers invalidation messages to every subscriber, the publisher included
+type InvalidationBus interface {
+	Publish(ctx context.Context, msg InvalidationMessage) error
+	// Subscribe calls handler for every message published after it, the returned func cancels the subscription
+	Subscribe(handler func(InvalidationMessage)) (func(), error)
+}
+
+var errBadInvalidation = fmt.Errorf("malformed invalidation message")
+
+type invalidation struct {
+	bus         InvalidationBus
+	id          string
+	localLevels int
+	unsubscribe func()
+}
+
+// SubscribeInvalidation connects the chain to bus: keys changed by Set, Del and their batch variants
+// are published to bus, keys published by other chains are evicted from the first localLevels levels.
+// Remote levels are shared, so they are never evicted. It has to be called before the chain is used
+func (c *ChainCache) SubscribeInvalidation(bus InvalidationBus, localLevels int) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	if c.invalidation != nil {
+		return fmt.Errorf("chain is already subscribed to an invalidation bus")
+	}
+	if localLevels < 0 || localLevels > len(c.chain) {
+		return fmt.Errorf("local levels must be in range 0..%d", len(c.chain))
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	inv := &invalidation{
+		bus:         bus,
+		id:          hex.EncodeToString(id),
+		localLevels: localLevels,
+	}
+	unsubscribe, err := bus.Subscribe(func(msg InvalidationMessage) {
+		c.evict(inv, msg)
+	})
+	if err != nil {
+		return err
+	}
+	inv.unsubscribe = unsubscribe
+	c.invalidation = inv
+	return nil
+}
+
+// evict deletes keys changed by other chains from the local levels
+func (c *ChainCache) evict(inv *invalidation, msg InvalidationMessage) {
+	if msg.Source == inv.id || len(msg.Keys) == 0 {
+		return
+	}
+	ctx := context.Background()
+	for ix := 0; ix < inv.localLevels; ix++ {
+		if err := c.chain[ix].MDelCtx(ctx, msg.Keys); err != nil {
+			c.notifyError(ix, "invalidate", err)
+		}
+	}
+	atomic.AddUint64(&c.invalidations, uint64(len(msg.Keys)))
+}
+
+// publish sends changed keys to other chains, a failure is swallowed by IgnoreErrors
+func (c *ChainCache) publish(ctx context.Context, keys ...string) error {
+	inv := c.invalidation
+	if inv == nil {
+		return nil
+	}
+	err := inv.bus.Publish(ctx, InvalidationMessage{Source: inv.id, Keys: keys})
+	if err != nil {
+		c.notifyError(-1, "publish", err)
+		if !c.IgnoreErrors {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ChainCache) publishItems(ctx context.Context, items []Item) error {
+	if c.invalidation == nil {
+		return nil
+	}
+	keys := make([]string, len(items))
+	for ix, item := range items {
+		keys[ix] = item.Key
+	}
+	return c.publish(ctx, keys...)
+}
+
+func (c *ChainCache) unsubscribe() {
+	if c.invalidation != nil {
+		c.invalidation.unsubscribe()
+		c.invalidation = nil
+	}
+}
+
+// ----------------------------------------------------------------------------------------
+
+// LocalInvalidationBus delivers messages inside the process synchronously from Publish,
+// it connects chains of one process and serves tests
+type LocalInvalidationBus struct {
+	mu       sync.RWMutex
+	next     int
+	handlers map[int]func(InvalidationMessage)
+}
+
+func NewLocalInvalidationBus() *LocalInvalidationBus {
+	return &LocalInvalidationBus{
+		handlers: make(map[int]func(InvalidationMessage)),
+	}
+}
+
+func (b *LocalInvalidationBus) Publish(ctx context.Context, msg InvalidationMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.RLock()
+	handlers := make([]func(InvalidationMessage), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *LocalInvalidationBus) Subscribe(handler func(InvalidationMessage)) (func(), error) {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+	}, nil
+}
+
+// ----------------------------------------------------------------------------------------
+
+// RedisPubSubClient is the part of redis client used by RedisInvalidationBus,
+// both redis.Client and redis.ClusterClient implement it
+type RedisPubSubClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// RedisInvalidationBus delivers messages through redis Pub/Sub channel. Pub/Sub does not keep
+// messages, so messages published while a subscriber reconnects are lost for it
+type RedisInvalidationBus struct {
+	client  RedisPubSubClient
+	channel string
+}
+
+func NewRedisInvalidationBus(client RedisPubSubClient, channel string) *RedisInvalidationBus {
+	return &RedisInvalidationBus{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// InvalidationBus returns the bus over the channel sharing the client of the cacher
+func (c *Rediscacher) InvalidationBus(channel string) (*RedisInvalidationBus, error) {
+	if !c.inited {
+		return nil, ErrNotInited
+	}
+	client, ok := c.client.(RedisPubSubClient)
+	if !ok {
+		return nil, fmt.Errorf("redis client does not support pub/sub")
+	}
+	return NewRedisInvalidationBus(client, channel), nil
+}
+
+func (b *RedisInvalidationBus) Publish(ctx context.Context, msg InvalidationMessage) error {
+	return b.client.Publish(ctx, b.channel, encodeInvalidation(msg)).Err()
+}
+
+func (b *RedisInvalidationBus) Subscribe(handler func(InvalidationMessage)) (func(), error) {
+	ctx := context.Background()
+	ps := b.client.Subscribe(ctx, b.channel)
+	// wait for the confirmation, so messages published after Subscribe are not missed
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	go func() {
+		for m := range ps.Channel() {
+			msg, err := decodeInvalidation([]byte(m.Payload))
+			if err != nil {
+				continue
+			}
+			handler(msg)
+		}
+	}()
+	return func() { ps.Close() }, nil
+}
+
+// invalidation message is the length-prefixed source followed by length-prefixed keys,
+// so binary keys survive the transport
+func encodeInvalidation(msg InvalidationMessage) []byte {
+	size := binary.MaxVarintLen64 + len(msg.Source)
+	for _, key := range msg.Keys {
+		size += binary.MaxVarintLen64 + len(key)
+	}
+	buf := make([]byte, 0, size)
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(msg.Source)))
+	buf = append(append(buf, lenBuf[:n]...), msg.Source...)
+	for _, key := range msg.Keys {
+		n = binary.PutUvarint(lenBuf[:], uint64(len(key)))
+		buf = append(append(buf, lenBuf[:n]...), key...)
+	}
+	return buf
+}
+
+func decodeInvalidation(data []byte) (InvalidationMessage, error) {
+	var (
+		msg   InvalidationMessage
+		first = true
+	)
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return InvalidationMessage{}, errBadInvalidation
+		}
+		s := string(data[n : n+int(size)])
+		data = data[n+int(size):]
+		if first {
+			msg.Source, first = s, false
+			continue
+		}
+		msg.Keys = append(msg.Keys, s)
+	}
+	if first {
+		return InvalidationMessage{}, errBadInvalidation
+	}
+	return msg, nil
+}
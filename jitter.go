@@ -0,0 +1,61 @@
+package chaincache
+
+import (
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Jitter shifts TTLs of written keys, so keys written at once (e.g. by a warmup after deploy)
+// do not expire at once. The shift is derived from a hash of the key: every write of a key gets
+// the same one. A chain backfills the rest of TTL as is, it has been shifted when the value was
+// written, only backfill TTLs taken from a BackfillPolicy are shifted. Zero TTLs are never shifted
+type Jitter struct {
+	// TTL is shifted by up to Percent of it in both directions
+	Percent float64 `yaml:"percent" json:"percent"`
+	// TTL is shifted by up to Window seconds in both directions, used when Percent is not set
+	Window int `yaml:"window" json:"window"`
+}
+
+func (j *Jitter) stringTTL(key string, ttl int) int {
+	if j == nil {
+		return ttl
+	}
+	return j.shift(ttl, xxhash.Sum64String(key))
+}
+
+func (j *Jitter) bytesTTL(key []byte, ttl int) int {
+	if j == nil {
+		return ttl
+	}
+	return j.shift(ttl, xxhash.Sum64(key))
+}
+
+func (j *Jitter) keyTTL(key chainKey, ttl int) int {
+	if key.bytes {
+		return j.bytesTTL(key.b, ttl)
+	}
+	return j.stringTTL(key.s, ttl)
+}
+
+func (j *Jitter) shift(ttl int, hash uint64) int {
+	window := float64(j.Window)
+	if j.Percent > 0 {
+		window = float64(ttl) * j.Percent / 100
+	}
+	// top 53 bits of the hash make a uniform float in [0, 1)
+	return jitterTTL(ttl, window, float64(hash>>11)/(1<<53))
+}
+
+// jitterTTL moves ttl by up to window seconds, r in [0, 1) picks the point of the window.
+// Zero TTL means no expiration for some cachers, so it is kept, and a TTL never drops below a second
+func jitterTTL(ttl int, window float64, r float64) int {
+	if ttl <= 0 || window <= 0 {
+		return ttl
+	}
+	jittered := int(math.Round(float64(ttl) + window*(2*r-1)))
+	if jittered < 1 {
+		return 1
+	}
+	return jittered
+}
@@ -0,0 +1,127 @@
+package chaincache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+type KeyHashAlgo uint8
+
+const (
+	// 64-bit xxhash, fast, collisions are caught by the guard
+	KEY_HASH_XXHASH KeyHashAlgo = iota
+	// SHA-256, collisions are practically impossible
+	KEY_HASH_SHA256
+)
+
+// hashed keys start with the prefix, raw keys starting with it are hashed too,
+// so a raw key never takes the place of a hashed one
+const HASHED_KEY_PREFIX = "#h:"
+
+// Values of hashed keys start with keyHashMagic, the length of the original key as uvarint
+// and the original key, it guards reads from values of other keys with the same hash
+var keyHashMagic = []byte{0xCC, 0x4B}
+
+// KeyHashingCacher replaces keys longer than MaxKeyLen bytes by their hash before passing them
+// to the wrapped cacher, so URL-sized keys fit limits of storages. The original key is stored
+// in the header of the value and checked on reads, a value of another key with the same hash
+// is a miss. Keys not longer than MaxKeyLen are passed as is, 0 hashes all keys.
+// Wrap a ChainCacher to hash keys of all levels of a chain
+type KeyHashingCacher struct {
+	decorator
+	Algo      KeyHashAlgo
+	MaxKeyLen int
+}
+
+func NewKeyHashingCacher(cacher Cacher, algo KeyHashAlgo, maxKeyLen int) (*KeyHashingCacher, error) {
+	switch algo {
+	case KEY_HASH_XXHASH, KEY_HASH_SHA256:
+	default:
+		return nil, fmt.Errorf("unknown key hash algorithm %d", algo)
+	}
+	c := &KeyHashingCacher{
+		Algo:      algo,
+		MaxKeyLen: maxKeyLen,
+	}
+	c.decorator = newDecorator(cacher, c, c)
+	return c, nil
+}
+
+func (c *KeyHashingCacher) hashed(key chainKey) bool {
+	if key.bytes {
+		return len(key.b) > c.MaxKeyLen || bytes.HasPrefix(key.b, []byte(HASHED_KEY_PREFIX))
+	}
+	return len(key.s) > c.MaxKeyLen || strings.HasPrefix(key.s, HASHED_KEY_PREFIX)
+}
+
+func (c *KeyHashingCacher) transformKey(key chainKey) chainKey {
+	if !c.hashed(key) {
+		return key
+	}
+	var sum []byte
+	switch c.Algo {
+	case KEY_HASH_SHA256:
+		var h [sha256.Size]byte
+		if key.bytes {
+			h = sha256.Sum256(key.b)
+		} else {
+			h = sha256.Sum256([]byte(key.s))
+		}
+		sum = h[:]
+	default:
+		var h uint64
+		if key.bytes {
+			h = xxhash.Sum64(key.b)
+		} else {
+			h = xxhash.Sum64String(key.s)
+		}
+		sum = make([]byte, 8)
+		binary.BigEndian.PutUint64(sum, h)
+	}
+	hashed := make([]byte, len(HASHED_KEY_PREFIX)+hex.EncodedLen(len(sum)))
+	copy(hashed, HASHED_KEY_PREFIX)
+	hex.Encode(hashed[len(HASHED_KEY_PREFIX):], sum)
+	if key.bytes {
+		return bytesKey(hashed)
+	}
+	return stringKey(string(hashed))
+}
+
+func (c *KeyHashingCacher) encodePayload(key chainKey, payload []byte) ([]byte, error) {
+	if !c.hashed(key) {
+		return payload, nil
+	}
+	original := key.String()
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(original)))
+	buf := make([]byte, 0, len(keyHashMagic)+n+len(original)+len(payload))
+	buf = append(buf, keyHashMagic...)
+	buf = append(buf, size[:n]...)
+	buf = append(buf, original...)
+	return append(buf, payload...), nil
+}
+
+func (c *KeyHashingCacher) decodePayload(key chainKey, data []byte) ([]byte, error) {
+	if !c.hashed(key) {
+		return data, nil
+	}
+	if !bytes.HasPrefix(data, keyHashMagic) {
+		return nil, ErrMiss
+	}
+	data = data[len(keyHashMagic):]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, ErrMiss
+	}
+	original := data[n : n+int(size)]
+	if key.bytes && !bytes.Equal(original, key.b) || !key.bytes && string(original) != key.s {
+		return nil, ErrMiss
+	}
+	return data[n+int(size):], nil
+}
@@ -0,0 +1,92 @@
+package chaincache
+
+import (
+	"context"
+	"time"
+)
+
+// Loader computes the value of a missed key and returns it with TTLs for every level of the chain.
+// Loader may return ErrNegativeHit with TTLs to cache the key as not existing.
+// If XFetch is set, the time the loader takes is stored with the value as its recompute cost
+type Loader func() ([]byte, []int, error)
+
+// TaggedLoader is Loader which also returns tags of the value, it is stored as by SetWithTags
+type TaggedLoader func() ([]byte, []int, []string, error)
+
+// GetOrLoad returns the value of key from the chain, on ErrMiss it calls loader and writes
+// its result through all levels of the chain. Concurrent misses of the same key share one
+// loader call, its error is returned to all of them. The returned slice may be shared between
+// callers and must not be modified
+func (c *ChainCache) GetOrLoad(key string, loader Loader) ([]byte, error) {
+	return c.GetOrLoadCtx(context.Background(), key, loader)
+}
+
+// GetOrLoadCtx is GetOrLoad which stops waiting for the loader when ctx is done.
+// The load itself goes on to serve other callers of the same key
+func (c *ChainCache) GetOrLoadCtx(ctx context.Context, key string, loader Loader) ([]byte, error) {
+	val, err := c.get(ctx, stringKey(key))
+	if err != ErrMiss {
+		return val, err
+	}
+
+	return c.getOrLoad(ctx, key, func() ([]byte, []int, []string, error) {
+		val, ttls, err := loader()
+		return val, ttls, nil, err
+	})
+}
+
+// GetOrLoadWithTags is GetOrLoad storing the loaded value with the tags returned by loader
+func (c *ChainCache) GetOrLoadWithTags(key string, loader TaggedLoader) ([]byte, error) {
+	return c.GetOrLoadWithTagsCtx(context.Background(), key, loader)
+}
+
+func (c *ChainCache) GetOrLoadWithTagsCtx(ctx context.Context, key string, loader TaggedLoader) ([]byte, error) {
+	val, err := c.get(ctx, stringKey(key))
+	if err != ErrMiss {
+		return val, err
+	}
+	return c.getOrLoad(ctx, key, loader)
+}
+
+func (c *ChainCache) getOrLoad(ctx context.Context, key string, loader TaggedLoader) ([]byte, error) {
+	ch := c.loads.DoChan(key, func() (interface{}, error) {
+		return c.load(key, loader)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load is shared between callers, so it must not depend on the context of any of them
+func (c *ChainCache) load(key string, loader TaggedLoader) ([]byte, error) {
+	start := time.Now()
+	val, ttls, tags, err := loader()
+	var cost time.Duration
+	if c.XFetch != nil {
+		cost = time.Since(start)
+	}
+	if err == ErrNegativeHit {
+		if err := c.setRaw(context.Background(), stringKey(key), negativeEntry, ttls); err != nil {
+			return nil, err
+		}
+		return nil, ErrNegativeHit
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	stamps, err := c.tagStamps(ctx, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setRaw(ctx, stringKey(key), c.encodeTagged(val, cost, stamps), ttls); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
@@ -0,0 +1,195 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the generation of a namespace is stored under the namespace name with the suffix
+	NAMESPACE_GENERATION_SUFFIX = ":generation"
+	// TTL of the stored generation when GenerationTTL is not set
+	DEFAULT_GENERATION_TTL = 30 * 24 * 60 * 60
+)
+
+type namespacePrefix struct {
+	generation uint64
+	s          string
+	b          []byte
+}
+
+// NamespacedCacher prefixes keys by the namespace and its generation, so services sharing
+// a storage do not collide. Bump switches the namespace to the next generation: entries of
+// the previous ones become unreachable at once and live out their TTL. The generation is kept
+// in the wrapped cacher, other instances pick up a bump by Refresh, which runs every
+// refreshInterval if it is set. Wrap a ChainCacher to switch all levels of a chain together,
+// the generation is kept only in the last level of the chain then, so local levels never hide a bump
+type NamespacedCacher struct {
+	decorator
+	namespace string
+
+	// TTL of the stored generation, default=DEFAULT_GENERATION_TTL
+	GenerationTTL int
+
+	// the cacher keeping the generation
+	generations ContextCacher
+	prefix      atomic.Value
+	stop        chan struct{}
+	refreshing  sync.WaitGroup
+}
+
+func NewNamespacedCacher(cacher Cacher, namespace string, refreshInterval time.Duration) (*NamespacedCacher, error) {
+	c := &NamespacedCacher{
+		namespace: namespace,
+	}
+	c.decorator = newDecorator(cacher, c, nil)
+	c.generations = generationLevel(c.next)
+	c.prefix.Store(c.newPrefix(0))
+	if err := c.Refresh(); err != nil {
+		return nil, fmt.Errorf("NewNamespacedCacher: %s", err)
+	}
+	if refreshInterval > 0 {
+		c.stop = make(chan struct{})
+		c.refreshing.Add(1)
+		go c.refreshEvery(refreshInterval, c.stop)
+	}
+	return c, nil
+}
+
+func (c *NamespacedCacher) transformKey(key chainKey) chainKey {
+	p := c.prefix.Load().(*namespacePrefix)
+	if key.bytes {
+		b := make([]byte, 0, len(p.b)+len(key.b))
+		return bytesKey(append(append(b, p.b...), key.b...))
+	}
+	return stringKey(p.s + key.s)
+}
+
+// Generation returns the current generation of the namespace
+func (c *NamespacedCacher) Generation() uint64 {
+	return c.prefix.Load().(*namespacePrefix).generation
+}
+
+// setGeneration switches to the generation unless the current one is the same or newer,
+// so a refresh racing with Bump does not bring back invalidated entries
+func (c *NamespacedCacher) setGeneration(generation uint64) {
+	var p *namespacePrefix
+	for {
+		current := c.prefix.Load().(*namespacePrefix)
+		if current.generation >= generation {
+			return
+		}
+		if p == nil {
+			p = c.newPrefix(generation)
+		}
+		if c.prefix.CompareAndSwap(current, p) {
+			return
+		}
+	}
+}
+
+func (c *NamespacedCacher) newPrefix(generation uint64) *namespacePrefix {
+	s := c.namespace + ":" + strconv.FormatUint(generation, 10) + ":"
+	return &namespacePrefix{
+		generation: generation,
+		s:          s,
+		b:          []byte(s),
+	}
+}
+
+func (c *NamespacedCacher) generationKey() string {
+	return c.namespace + NAMESPACE_GENERATION_SUFFIX
+}
+
+// generationLevel returns the last level of a wrapped chain, nested chains included, or cacher itself.
+// Local levels of a chain would keep the generation read before a bump of another instance
+func generationLevel(cacher ContextCacher) ContextCacher {
+	for {
+		var wrapped Cacher = cacher
+		if cc, ok := wrapped.(*contextCacher); ok {
+			wrapped = cc.Cacher
+		}
+		chain, ok := wrapped.(*ChainCacher)
+		if !ok {
+			return cacher
+		}
+		cacher = chain.chain[len(chain.chain)-1]
+	}
+}
+
+func (c *NamespacedCacher) storeGeneration(ctx context.Context, generation uint64) error {
+	ttl := c.GenerationTTL
+	if ttl <= 0 {
+		ttl = DEFAULT_GENERATION_TTL
+	}
+	return c.generations.SetCtx(ctx, c.generationKey(), []byte(strconv.FormatUint(generation, 10)), ttl)
+}
+
+// Refresh loads the generation stored by other instances. A generation never goes back:
+// if the stored one is lost or older, the current one is stored again
+func (c *NamespacedCacher) Refresh() error {
+	return c.RefreshCtx(context.Background())
+}
+
+func (c *NamespacedCacher) RefreshCtx(ctx context.Context) error {
+	data, err := c.generations.GetCtx(ctx, c.generationKey())
+	if err != nil && err != ErrMiss {
+		return err
+	}
+	current := c.Generation()
+	stored, perr := strconv.ParseUint(string(data), 10, 64)
+	if err == ErrMiss || perr != nil || stored < current {
+		if current == 0 {
+			return nil
+		}
+		return c.storeGeneration(ctx, current)
+	}
+	c.setGeneration(stored)
+	return nil
+}
+
+// Bump switches the namespace to the next generation
+func (c *NamespacedCacher) Bump() error {
+	return c.BumpCtx(context.Background())
+}
+
+func (c *NamespacedCacher) BumpCtx(ctx context.Context) error {
+	if err := c.RefreshCtx(ctx); err != nil {
+		return err
+	}
+	next := c.Generation() + 1
+	if err := c.storeGeneration(ctx, next); err != nil {
+		return err
+	}
+	c.setGeneration(next)
+	return nil
+}
+
+func (c *NamespacedCacher) refreshEvery(interval time.Duration, stop chan struct{}) {
+	defer c.refreshing.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a failed refresh is retried on the next tick
+			c.Refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing of the generation and closes the wrapped cacher
+func (c *NamespacedCacher) Close() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+		c.refreshing.Wait()
+	}
+	c.next.Close()
+}
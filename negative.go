@@ -0,0 +1,39 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrNegativeHit is returned by the chain for keys stored by SetNegative, it means the key
+// is known to not exist in the origin and deeper cachers have not been asked
+var ErrNegativeHit = fmt.Errorf("key is cached as not existing")
+
+// SetNegative remembers in every cacher of the chain that the key does not exist.
+// Get of the key returns ErrNegativeHit until the tombstone expires
+func (c *ChainCache) SetNegative(key string, ttlSeconds []int) error {
+	return c.setRaw(context.Background(), stringKey(key), negativeEntry, ttlSeconds)
+}
+
+func (c *ChainCache) SetNegativeCtx(ctx context.Context, key string, ttlSeconds []int) error {
+	return c.setRaw(ctx, stringKey(key), negativeEntry, ttlSeconds)
+}
+
+func (c *ChainCache) BSetNegative(key []byte, ttlSeconds []int) error {
+	return c.setRaw(context.Background(), bytesKey(key), negativeEntry, ttlSeconds)
+}
+
+func (c *ChainCache) BSetNegativeCtx(ctx context.Context, key []byte, ttlSeconds []int) error {
+	return c.setRaw(ctx, bytesKey(key), negativeEntry, ttlSeconds)
+}
+
+// GetNegativeHits returns the number of lookups answered by a tombstone
+func (c *ChainCache) GetNegativeHits() uint64 {
+	return atomic.LoadUint64(&c.negativeHits)
+}
+
+// GetNegativeBackfills returns the number of tombstones written back to the preceding cachers
+func (c *ChainCache) GetNegativeBackfills() uint64 {
+	return atomic.LoadUint64(&c.negativeBackfills)
+}
@@ -0,0 +1,150 @@
+package chaincache
+
+import "time"
+
+// Observer is notified about cache events. It is called synchronously on the path of
+// the operation, so it has to be fast and safe for concurrent use. level is the index
+// of the cacher in the chain, op is get, set, del, backfill, tags (lookup of tag versions) or a batch one (mget, mset, mdel).
+// Evictions by the invalidation bus fail with op invalidate, publishing fails with op publish and level -1,
+// background writes of write-behind fail with op writebehind
+type Observer interface {
+	// key is found on the level, negative entries count as hits too
+	OnHit(level int, key string)
+	// key is missed on every level
+	OnMiss(key string)
+	// value found on a deeper level is written back to the level
+	OnBackfill(level int, key string)
+	// operation on the level failed, the error may be swallowed by IgnoreErrors
+	OnError(level int, op string, err error)
+	// key is stored
+	OnSet(key string)
+	// key is deleted
+	OnDel(key string)
+}
+
+// NopObserver ignores all events, embed it to implement only the needed methods of Observer
+type NopObserver struct{}
+
+func (NopObserver) OnHit(level int, key string)             {}
+func (NopObserver) OnMiss(key string)                       {}
+func (NopObserver) OnBackfill(level int, key string)        {}
+func (NopObserver) OnError(level int, op string, err error) {}
+func (NopObserver) OnSet(key string)                        {}
+func (NopObserver) OnDel(key string)                        {}
+
+// chain notifications do nothing without an observer, keys are only converted for it
+
+func (c *ChainCache) notifyHit(level int, key chainKey) {
+	if c.Observer != nil {
+		c.Observer.OnHit(level, key.String())
+	}
+}
+
+func (c *ChainCache) notifyMiss(key chainKey) {
+	if c.Observer != nil {
+		c.Observer.OnMiss(key.String())
+	}
+}
+
+func (c *ChainCache) notifyBackfill(level int, key chainKey) {
+	if c.Observer != nil {
+		c.Observer.OnBackfill(level, key.String())
+	}
+}
+
+func (c *ChainCache) notifyError(level int, op string, err error) {
+	if c.Observer != nil {
+		c.Observer.OnError(level, op, err)
+	}
+}
+
+func (c *ChainCache) notifySet(key chainKey) {
+	if c.Observer != nil {
+		c.Observer.OnSet(key.String())
+	}
+}
+
+func (c *ChainCache) notifyDel(key chainKey) {
+	if c.Observer != nil {
+		c.Observer.OnDel(key.String())
+	}
+}
+
+func (c *ChainCache) notifyHitItems(level int, items []Item) {
+	if c.Observer != nil {
+		for _, item := range items {
+			c.Observer.OnHit(level, item.Key)
+		}
+	}
+}
+
+func (c *ChainCache) notifyMissKeys(keys []string) {
+	if c.Observer != nil {
+		for _, key := range keys {
+			c.Observer.OnMiss(key)
+		}
+	}
+}
+
+func (c *ChainCache) notifyBackfillItems(level int, items []Item) {
+	if c.Observer != nil {
+		for _, item := range items {
+			c.Observer.OnBackfill(level, item.Key)
+		}
+	}
+}
+
+func (c *ChainCache) notifySetItems(items []Item) {
+	if c.Observer != nil {
+		for _, item := range items {
+			c.Observer.OnSet(item.Key)
+		}
+	}
+}
+
+func (c *ChainCache) notifyDelKeys(keys []string) {
+	if c.Observer != nil {
+		for _, key := range keys {
+			c.Observer.OnDel(key)
+		}
+	}
+}
+
+// ObservedCacher notifies Observer about operations of the wrapped cacher,
+// events are reported with Level as the level of the cacher
+type ObservedCacher struct {
+	decorator
+	Level    int
+	Observer Observer
+}
+
+func NewObservedCacher(cacher Cacher, observer Observer) *ObservedCacher {
+	c := &ObservedCacher{
+		Observer: observer,
+	}
+	c.decorator = newDecorator(cacher, nil, nil)
+	c.observer = c
+	c.watcher = c
+	return c
+}
+
+func (c *ObservedCacher) observeOp(op string, elapsed time.Duration, hits int, misses int, err error) {
+	if err != nil {
+		c.Observer.OnError(c.Level, op, err)
+	}
+}
+
+func (c *ObservedCacher) observeKey(op string, key chainKey, err error) {
+	switch op {
+	case "get":
+		if err == ErrMiss {
+			c.Observer.OnMiss(key.String())
+		} else {
+			c.Observer.OnHit(c.Level, key.String())
+		}
+	case "set":
+		c.Observer.OnSet(key.String())
+	case "del":
+		c.Observer.OnDel(key.String())
+	}
+}
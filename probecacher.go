@@ -1,8 +1,9 @@
 package chaincache
 
 import (
+	"context"
 	"fmt"
-	"sync/atomic"
+	"time"
 
 	"github.com/n1ord/probecache"
 )
@@ -15,10 +16,13 @@ const (
 )
 
 type Probecacher struct {
+	cacherStats
+
+	// shifts TTLs of written keys, nil disables
+	Jitter *Jitter
+
 	inited bool
 	cache  probecache.IStorage
-	hits   uint32
-	misses uint32
 }
 
 func NewProbecacher(shards int, maxSize int, maxCritSize int, maxDepth int, strategy StorageStrategy) (*Probecacher, error) {
@@ -50,8 +54,7 @@ func (c *Probecacher) Init() error {
 	if c.inited {
 		return nil
 	}
-	atomic.StoreUint32(&c.hits, 0)
-	atomic.StoreUint32(&c.misses, 0)
+	c.resetStats()
 	c.inited = true
 	return nil
 }
@@ -60,23 +63,25 @@ func (c *Probecacher) GetWithTTL(key string) ([]byte, int, error) {
 	if !c.inited {
 		return nil, 0, ErrNotInited
 	}
+	start := time.Now()
+	val, ttl, err := c.getWithTTL(key)
+	c.done(opGet, start, err)
+	return val, ttl, err
+}
+
+func (c *Probecacher) getWithTTL(key string) ([]byte, int, error) {
 	// log.Printf("Freecache: get %s", key)
 	value, ttl, err := c.cache.GetWithTTL(key)
 	if err != nil {
 		if err == probecache.ErrMissing {
-			atomic.AddUint32(&c.misses, 1)
 			return nil, 0, ErrMiss
 		}
 		return nil, 0, fmt.Errorf("internal cache error: %s", err)
 	}
-	atomic.AddUint32(&c.hits, 1)
 	return value, int(ttl), nil
 }
 
 func (c *Probecacher) Get(key string) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
 	val, _, err := c.GetWithTTL(key)
 	return val, err
 }
@@ -86,58 +91,37 @@ func (c *Probecacher) Set(key string, payload []byte, ttlSeconds int) error {
 		return ErrNotInited
 	}
 	// log.Printf("Freecache: set %s", key)
-	return c.cache.Set(key, payload, uint64(ttlSeconds))
+	start := time.Now()
+	err := c.cache.Set(key, payload, uint64(c.Jitter.stringTTL(key, ttlSeconds)))
+	c.done(opSet, start, err)
+	return err
 }
 
 func (c *Probecacher) Del(key string) error {
 	if !c.inited {
 		return ErrNotInited
 	}
+	start := time.Now()
 	c.cache.Del(key)
-
+	c.done(opDel, start, nil)
 	return nil
 }
 
 func (c *Probecacher) BGetWithTTL(key []byte) ([]byte, int, error) {
-	if !c.inited {
-		return nil, 0, ErrNotInited
-	}
-	// log.Printf("Freecache: get %s", key)
-	value, ttl, err := c.cache.GetWithTTL(string(key))
-	if err != nil {
-		if err == probecache.ErrMissing {
-			atomic.AddUint32(&c.misses, 1)
-			return nil, 0, ErrMiss
-		}
-		return nil, 0, fmt.Errorf("internal cache error: %s", err)
-	}
-	atomic.AddUint32(&c.hits, 1)
-	return value, int(ttl), nil
+	return c.GetWithTTL(string(key))
 }
 
 func (c *Probecacher) BGet(key []byte) ([]byte, error) {
-	if !c.inited {
-		return nil, ErrNotInited
-	}
 	val, _, err := c.GetWithTTL(string(key))
 	return val, err
 }
 
 func (c *Probecacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	// log.Printf("Freecache: set %s", key)
-	return c.cache.Set(string(key), payload, uint64(ttlSeconds))
+	return c.Set(string(key), payload, ttlSeconds)
 }
 
 func (c *Probecacher) BDel(key []byte) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	c.cache.Del(string(key))
-
-	return nil
+	return c.Del(string(key))
 }
 
 func (c *Probecacher) Close() {
@@ -149,14 +133,126 @@ func (c *Probecacher) Close() {
 
 func (c *Probecacher) Reset() {
 	c.cache.Clear()
+	c.resetStats()
 }
 
-func (c *Probecacher) GetHits() uint32 {
-	return atomic.LoadUint32(&c.hits)
+// ------------------------------------------------------------------------------------------------
+
+func (c *Probecacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(key)
 }
 
-func (c *Probecacher) GetMisses() uint32 {
-	return atomic.LoadUint32(&c.misses)
+func (c *Probecacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.GetWithTTL(key)
+}
+
+func (c *Probecacher) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, payload, ttlSeconds)
+}
+
+func (c *Probecacher) DelCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Del(key)
+}
+
+func (c *Probecacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.BGet(key)
+}
+
+func (c *Probecacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.BGetWithTTL(key)
+}
+
+func (c *Probecacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BSet(key, payload, ttlSeconds)
+}
+
+func (c *Probecacher) BDelCtx(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.BDel(key)
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (c *Probecacher) MGet(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, func(key string) ([]byte, int, error) {
+		val, err := c.Get(key)
+		return val, 0, err
+	})
+}
+
+func (c *Probecacher) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	if !c.inited {
+		return nil, nil, ErrNotInited
+	}
+	return mgetEach(keys, c.GetWithTTL)
+}
+
+func (c *Probecacher) MSet(items []Item) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return msetEach(items, c.Set)
+}
+
+func (c *Probecacher) MDel(keys []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return mdelEach(keys, c.Del)
+}
+
+func (c *Probecacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGet(keys)
+}
+
+func (c *Probecacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.MGetWithTTL(keys)
+}
+
+func (c *Probecacher) MSetCtx(ctx context.Context, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MSet(items)
+}
+
+func (c *Probecacher) MDelCtx(ctx context.Context, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.MDel(keys)
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -0,0 +1,288 @@
+package chaincache
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector exports metrics of registered cachers and chains to prometheus:
+//
+//	{ns}_cacher_operations_total{cacher,level,op,result}  operations by result ok|error
+//	{ns}_cacher_operation_duration_seconds{cacher,level,op} operation latency
+//	{ns}_cacher_lookups_total{cacher,level,result}         looked up keys by result hit|miss
+//	{ns}_cacher_entries{cacher,level}                      entries in local cachers
+//	{ns}_cacher_size_bytes{cacher,level}                   memory used by local cachers
+//	{ns}_chain_lookups_total{chain,result}                 chain lookups by result hit|miss|negative_hit|stale_hit
+//	{ns}_chain_refreshes_total{chain,trigger}              background refreshes by trigger revalidate|xfetch
+//	{ns}_chain_refresh_errors_total{chain}                 failed background refreshes
+//	{ns}_chain_backfills_total{chain,level,result}         values written back to the level by result ok|error
+//	{ns}_chain_swallowed_errors_total{chain,level}         errors of the level hidden by IgnoreErrors
+//
+// level is the index of the cacher in its chain, empty for standalone cachers
+type Collector struct {
+	ops       *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	lookups   *prometheus.CounterVec
+
+	entries       *prometheus.Desc
+	size          *prometheus.Desc
+	chainLookups  *prometheus.Desc
+	refreshes     *prometheus.Desc
+	refreshErrors *prometheus.Desc
+	backfills     *prometheus.Desc
+	swallowed     *prometheus.Desc
+
+	mu      sync.Mutex
+	cachers []*InstrumentedCacher
+	chains  map[string]*ChainCache
+}
+
+// NewCollector creates a collector with metric names prefixed by namespace,
+// it has to be registered in a prometheus registry as usual
+func NewCollector(namespace string) *Collector {
+	cacherLabels := []string{"cacher", "level"}
+	return &Collector{
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cacher_operations_total",
+			Help:      "Cacher operations by result.",
+		}, []string{"cacher", "level", "op", "result"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cacher_operation_duration_seconds",
+			Help:      "Cacher operation latency.",
+			Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 9),
+		}, []string{"cacher", "level", "op"}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cacher_lookups_total",
+			Help:      "Keys looked up in cacher by result.",
+		}, []string{"cacher", "level", "result"}),
+		entries: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cacher_entries"),
+			"Entries stored in local cacher.", cacherLabels, nil),
+		size: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cacher_size_bytes"),
+			"Memory used by local cacher.", cacherLabels, nil),
+		chainLookups: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "chain_lookups_total"),
+			"Chain lookups by result.", []string{"chain", "result"}, nil),
+		refreshes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "chain_refreshes_total"),
+			"Chain background refreshes by trigger.", []string{"chain", "trigger"}, nil),
+		refreshErrors: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "chain_refresh_errors_total"),
+			"Chain background refreshes failed.", []string{"chain"}, nil),
+		backfills: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "chain_backfills_total"),
+			"Values written back to chain level by result.", []string{"chain", "level", "result"}, nil),
+		swallowed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "chain_swallowed_errors_total"),
+			"Errors of chain level hidden by IgnoreErrors.", []string{"chain", "level"}, nil),
+		chains: make(map[string]*ChainCache),
+	}
+}
+
+// Register wraps cacher to count its operations under the name,
+// the returned cacher has to be used instead of the original one
+func (c *Collector) Register(name string, cacher Cacher) *InstrumentedCacher {
+	return c.instrument(name, "", cacher)
+}
+
+// NewChainCache makes a chain of instrumented cachers and exports the chain counters under the name,
+// the levels are wrapped before the chain is built, so it is the safe way to instrument a new chain
+func (c *Collector) NewChainCache(name string, cachers ...Cacher) (*ChainCache, error) {
+	if err := c.reserveChain(name); err != nil {
+		return nil, err
+	}
+	instrumented := make([]Cacher, len(cachers))
+	for ix, cacher := range cachers {
+		instrumented[ix] = c.instrument(name, strconv.Itoa(ix), cacher)
+	}
+	chain, err := NewChainCache(instrumented...)
+	c.mu.Lock()
+	if err != nil {
+		delete(c.chains, name)
+	} else {
+		c.chains[name] = chain
+	}
+	c.mu.Unlock()
+	return chain, err
+}
+
+// RegisterChain wraps every level of chain to count their operations and exports
+// the chain counters under the name. The levels are swapped without any synchronization,
+// so it has to be called before the chain is used or shared with other goroutines,
+// e.g. right after NewChainCacheFromConfig. New chains are better made by NewChainCache
+func (c *Collector) RegisterChain(name string, chain *ChainCache) error {
+	if err := c.reserveChain(name); err != nil {
+		return err
+	}
+
+	for ix, cacher := range chain.chain {
+		chain.chain[ix] = c.instrument(name, strconv.Itoa(ix), cacher)
+	}
+
+	c.mu.Lock()
+	c.chains[name] = chain
+	c.mu.Unlock()
+	return nil
+}
+
+// reserveChain takes the name for a chain being registered, Collect skips nil chains
+func (c *Collector) reserveChain(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.chains[name]; exists {
+		return fmt.Errorf("chain %q is already registered", name)
+	}
+	c.chains[name] = nil
+	return nil
+}
+
+func (c *Collector) instrument(name string, level string, cacher Cacher) *InstrumentedCacher {
+	ic := &InstrumentedCacher{
+		name:  name,
+		level: level,
+		ops:   make(map[string]*opMetrics, 6),
+	}
+	for _, op := range []string{"get", "set", "del", "mget", "mset", "mdel"} {
+		ic.ops[op] = &opMetrics{
+			ok:       c.ops.WithLabelValues(name, level, op, "ok"),
+			failed:   c.ops.WithLabelValues(name, level, op, "error"),
+			duration: c.durations.WithLabelValues(name, level, op),
+		}
+	}
+	ic.hits = c.lookups.WithLabelValues(name, level, "hit")
+	ic.misses = c.lookups.WithLabelValues(name, level, "miss")
+	ic.decorator = newDecorator(cacher, nil, nil)
+	ic.observer = ic
+
+	c.mu.Lock()
+	c.cachers = append(c.cachers, ic)
+	c.mu.Unlock()
+	return ic
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.ops.Describe(ch)
+	c.durations.Describe(ch)
+	c.lookups.Describe(ch)
+	ch <- c.entries
+	ch <- c.size
+	ch <- c.chainLookups
+	ch <- c.refreshes
+	ch <- c.refreshErrors
+	ch <- c.backfills
+	ch <- c.swallowed
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.ops.Collect(ch)
+	c.durations.Collect(ch)
+	c.lookups.Collect(ch)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ic := range c.cachers {
+		entries, size, ok := localStats(ic.next)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(entries), ic.name, ic.level)
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size), ic.name, ic.level)
+	}
+
+	for name, chain := range c.chains {
+		if chain == nil {
+			continue
+		}
+		// chain counters go down on Reset, prometheus handles it as a counter reset
+		stats := chain.Stats()
+		ch <- prometheus.MustNewConstMetric(c.chainLookups, prometheus.CounterValue, float64(stats.Hits), name, "hit")
+		ch <- prometheus.MustNewConstMetric(c.chainLookups, prometheus.CounterValue, float64(stats.Misses), name, "miss")
+		ch <- prometheus.MustNewConstMetric(c.chainLookups, prometheus.CounterValue, float64(stats.NegativeHits), name, "negative_hit")
+		ch <- prometheus.MustNewConstMetric(c.chainLookups, prometheus.CounterValue, float64(stats.StaleHits), name, "stale_hit")
+		ch <- prometheus.MustNewConstMetric(c.refreshes, prometheus.CounterValue, float64(stats.Refreshes), name, "revalidate")
+		ch <- prometheus.MustNewConstMetric(c.refreshes, prometheus.CounterValue, float64(stats.EarlyRefreshes), name, "xfetch")
+		ch <- prometheus.MustNewConstMetric(c.refreshErrors, prometheus.CounterValue, float64(stats.RefreshErrors), name)
+		for ix, level := range stats.Levels {
+			lvl := strconv.Itoa(ix)
+			ch <- prometheus.MustNewConstMetric(c.backfills, prometheus.CounterValue, float64(level.Backfills), name, lvl, "ok")
+			ch <- prometheus.MustNewConstMetric(c.backfills, prometheus.CounterValue, float64(level.BackfillErrors), name, lvl, "error")
+			ch <- prometheus.MustNewConstMetric(c.swallowed, prometheus.CounterValue, float64(level.Errors), name, lvl)
+		}
+	}
+}
+
+// localStats returns the number of entries and bytes used by a local cacher
+// looking through decorators, ok is false for other cachers
+func localStats(cacher Cacher) (entries uint64, size uint64, ok bool) {
+	for {
+		switch c := cacher.(type) {
+		case *Fastcacher:
+			if !c.inited {
+				return 0, 0, false
+			}
+			var stats fastcache.Stats
+			c.cache.UpdateStats(&stats)
+			return stats.EntriesCount, stats.BytesSize, true
+		case *Freecacher:
+			if !c.inited {
+				return 0, 0, false
+			}
+			return uint64(c.cache.EntryCount()), freecacheSize(c.MaxSize), true
+		case interface{ Unwrap() Cacher }:
+			cacher = c.Unwrap()
+		default:
+			return 0, 0, false
+		}
+	}
+}
+
+// freecache preallocates its memory at once: at least freecacheMinSize split evenly into freecacheSegments ring buffers
+const (
+	freecacheMinSize  = 512 * 1024
+	freecacheSegments = 256
+)
+
+// freecacheSize is the memory freecache allocates for maxSize
+func freecacheSize(maxSize int) uint64 {
+	if maxSize < freecacheMinSize {
+		maxSize = freecacheMinSize
+	}
+	return uint64(maxSize / freecacheSegments * freecacheSegments)
+}
+
+type opMetrics struct {
+	ok       prometheus.Counter
+	failed   prometheus.Counter
+	duration prometheus.Observer
+}
+
+// InstrumentedCacher counts operations of the wrapped cacher for Collector
+type InstrumentedCacher struct {
+	decorator
+	name   string
+	level  string
+	ops    map[string]*opMetrics
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+func (c *InstrumentedCacher) observeOp(op string, elapsed time.Duration, hits int, misses int, err error) {
+	m := c.ops[op]
+	if err != nil {
+		m.failed.Inc()
+	} else {
+		m.ok.Inc()
+	}
+	m.duration.Observe(elapsed.Seconds())
+	if hits > 0 {
+		c.hits.Add(float64(hits))
+	}
+	if misses > 0 {
+		c.misses.Add(float64(misses))
+	}
+}
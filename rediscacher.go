@@ -3,10 +3,10 @@ package chaincache
 import (
 	"context"
 	"errors"
-	"sync/atomic"
 	"time"
 
 	redis "github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type RedisClientIface interface {
@@ -18,29 +18,41 @@ type RedisClientIface interface {
 	Close() error
 }
 
+// RedisBatchClient is the part of redis client used by batch operations of Rediscacher,
+// both redis.Client and redis.ClusterClient implement it. Batch operations over a client
+// without it are done key by key
+type RedisBatchClient interface {
+	MGet(context.Context, ...string) *redis.SliceCmd
+	Pipeline() redis.Pipeliner
+}
+
 type RediscacherCfg struct {
-	Hosts          []string `yaml:"hosts"`
-	Host           string   `yaml:"host"`
-	Username       string   `yaml:"username"`
-	Password       string   `yaml:"password"`
-	MaxRetries     int      `yaml:"max_retries"`
-	DialTimeoutMs  int64    `yaml:"dial_timeout_ms"`
-	ReadTimeoutMs  int64    `yaml:"read_timeout_ms"`
-	WriteTimeoutMs int64    `yaml:"write_timeout_ms"`
-	PoolSize       int      `yaml:"pool_size"`
-	ClusterMode    bool     `yaml:"cluster_mode"`
+	Hosts          []string `yaml:"hosts" json:"hosts"`
+	Host           string   `yaml:"host" json:"host"`
+	Username       string   `yaml:"username" json:"username"`
+	Password       string   `yaml:"password" json:"password"`
+	MaxRetries     int      `yaml:"max_retries" json:"max_retries"`
+	DialTimeoutMs  int64    `yaml:"dial_timeout_ms" json:"dial_timeout_ms"`
+	ReadTimeoutMs  int64    `yaml:"read_timeout_ms" json:"read_timeout_ms"`
+	WriteTimeoutMs int64    `yaml:"write_timeout_ms" json:"write_timeout_ms"`
+	PoolSize       int      `yaml:"pool_size" json:"pool_size"`
+	ClusterMode    bool     `yaml:"cluster_mode" json:"cluster_mode"`
 }
 
 type Rediscacher struct {
+	cacherStats
+
 	client RedisClientIface
 	cfg    *RediscacherCfg
 
-	inited         bool
-	ctx            context.Context
-	hits           uint32
-	misses         uint32
-	requestTimeSum float64
-	requestCount   uint32
+	// Tracer of redis requests, spans are children of the span in the context of a request, nil disables tracing
+	Tracer trace.Tracer
+
+	// shifts TTLs of written keys, nil disables
+	Jitter *Jitter
+
+	inited   bool
+	tracking *redisTracking
 }
 
 func (c *Rediscacher) newRedisClient(cfg *RediscacherCfg) RedisClientIface {
@@ -89,9 +101,7 @@ func NewRediccacherWithClient(client RedisClientIface) (*Rediscacher, error) {
 	c.client = client
 	c.cfg = nil
 
-	c.ctx = context.Background()
-
-	err := c.client.Ping(c.ctx).Err()
+	err := c.client.Ping(context.Background()).Err()
 	if err != nil {
 		return nil, err
 	}
@@ -122,9 +132,7 @@ func (c *Rediscacher) Init() error {
 		c.client = c.newRedisClient(c.cfg)
 	}
 
-	c.ctx = context.Background()
-
-	err := c.client.Ping(c.ctx).Err()
+	err := c.client.Ping(context.Background()).Err()
 	if err != nil {
 		return err
 	}
@@ -133,13 +141,21 @@ func (c *Rediscacher) Init() error {
 }
 
 func (c *Rediscacher) Set(key string, payload []byte, ttlSeconds int) error {
+	return c.SetCtx(context.Background(), key, payload, ttlSeconds)
+}
+
+func (c *Rediscacher) SetCtx(ctx context.Context, key string, payload []byte, ttlSeconds int) error {
 	if !c.inited {
 		return ErrNotInited
 	}
+	ttlSeconds = c.Jitter.stringTTL(key, ttlSeconds)
+	ctx, sp := startDBSpan(ctx, c.Tracer, "redis", "SET", stringKey(key))
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(payload))
+	sp.setInt(ATTR_TTL, ttlSeconds)
 	start := time.Now()
-	err := c.client.Set(c.ctx, key, payload, time.Duration(ttlSeconds*int(time.Second))).Err()
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
+	err := c.client.Set(ctx, key, payload, time.Duration(ttlSeconds*int(time.Second))).Err()
+	c.done(opSet, start, err)
+	sp.end(err)
 	if err != nil {
 		return err
 	}
@@ -147,179 +163,307 @@ func (c *Rediscacher) Set(key string, payload []byte, ttlSeconds int) error {
 }
 
 func (c *Rediscacher) Get(key string) ([]byte, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+func (c *Rediscacher) GetCtx(ctx context.Context, key string) ([]byte, error) {
 	if !c.inited {
 		return nil, ErrNotInited
 	}
 
+	ctx, sp := startDBSpan(ctx, c.Tracer, "redis", "GET", stringKey(key))
 	start := time.Now()
-	cmd := c.client.Get(c.ctx, key)
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
-	res, err := cmd.Bytes()
+	res, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		err = ErrMiss
+	}
+	c.done(opGet, start, err)
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(res))
+	sp.end(err)
 	if err != nil {
-		if err == redis.Nil {
-			atomic.AddUint32(&c.misses, 1)
-			return nil, ErrMiss
-		}
 		return nil, err
 	}
-	atomic.AddUint32(&c.hits, 1)
 	return res, nil
 }
 
 func (c *Rediscacher) GetWithTTL(key string) ([]byte, int, error) {
+	return c.GetWithTTLCtx(context.Background(), key)
+}
+
+func (c *Rediscacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
 	if !c.inited {
 		return nil, 0, ErrNotInited
 	}
 	start := time.Now()
-	res, err := c.client.Get(c.ctx, key).Bytes()
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
+	res, ttl, err := c.getWithTTL(ctx, key)
+	c.done(opGet, start, err)
+	return res, ttl, err
+}
+
+func (c *Rediscacher) getWithTTL(ctx context.Context, key string) ([]byte, int, error) {
+	gctx, sp := startDBSpan(ctx, c.Tracer, "redis", "GET", stringKey(key))
+	res, err := c.client.Get(gctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
-			atomic.AddUint32(&c.misses, 1)
+			sp.end(ErrMiss)
 			return nil, 0, ErrMiss
 		}
+		sp.end(err)
 		return nil, 0, err
 	}
+	sp.setInt(ATTR_PAYLOAD_SIZE, len(res))
+	sp.end(nil)
 
-	start = time.Now()
-	cmd := c.client.TTL(c.ctx, key)
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
+	tctx, sp := startDBSpan(ctx, c.Tracer, "redis", "TTL", stringKey(key))
+	cmd := c.client.TTL(tctx, key)
+	sp.end(cmd.Err())
 	if cmd.Err() != nil {
 		return nil, 0, cmd.Err()
 	}
-	ttl := int(cmd.Val().Seconds())
-
-	atomic.AddUint32(&c.hits, 1)
-	return res, ttl, nil
+	return res, int(cmd.Val().Seconds()), nil
 }
 
 func (c *Rediscacher) Del(key string) error {
+	return c.DelCtx(context.Background(), key)
+}
+
+func (c *Rediscacher) DelCtx(ctx context.Context, key string) error {
 	if !c.inited {
 		return ErrNotInited
 	}
 
-	res, err := c.client.Del(c.ctx, key).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return ErrMiss
-		}
-		return err
-	}
-	if res == 0 {
-		return ErrMiss
+	ctx, sp := startDBSpan(ctx, c.Tracer, "redis", "DEL", stringKey(key))
+	start := time.Now()
+	res, err := c.client.Del(ctx, key).Result()
+	if err == redis.Nil || (err == nil && res == 0) {
+		err = ErrMiss
 	}
-
-	return nil
+	c.done(opDel, start, err)
+	sp.end(err)
+	return err
 }
 
 func (c *Rediscacher) BSet(key []byte, payload []byte, ttlSeconds int) error {
-	if !c.inited {
-		return ErrNotInited
-	}
-	start := time.Now()
-	err := c.client.Set(c.ctx, string(key), payload, time.Duration(ttlSeconds*int(time.Second))).Err()
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.SetCtx(context.Background(), string(key), payload, ttlSeconds)
+}
+
+func (c *Rediscacher) BSetCtx(ctx context.Context, key []byte, payload []byte, ttlSeconds int) error {
+	return c.SetCtx(ctx, string(key), payload, ttlSeconds)
 }
 
 func (c *Rediscacher) BGet(key []byte) ([]byte, error) {
+	return c.GetCtx(context.Background(), string(key))
+}
+
+func (c *Rediscacher) BGetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	return c.GetCtx(ctx, string(key))
+}
+
+func (c *Rediscacher) BGetWithTTL(key []byte) ([]byte, int, error) {
+	return c.GetWithTTLCtx(context.Background(), string(key))
+}
+
+func (c *Rediscacher) BGetWithTTLCtx(ctx context.Context, key []byte) ([]byte, int, error) {
+	return c.GetWithTTLCtx(ctx, string(key))
+}
+
+func (c *Rediscacher) BDel(key []byte) error {
+	return c.DelCtx(context.Background(), string(key))
+}
+
+func (c *Rediscacher) BDelCtx(ctx context.Context, key []byte) error {
+	return c.DelCtx(ctx, string(key))
+}
+
+func (c *Rediscacher) MGet(keys []string) ([]Item, []string, error) {
+	return c.MGetCtx(context.Background(), keys)
+}
+
+// MGetCtx uses MGET for a single redis and pipelined GETs for a cluster,
+// where keys of one MGET must belong to the same slot
+func (c *Rediscacher) MGetCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
 	if !c.inited {
-		return nil, ErrNotInited
+		return nil, nil, ErrNotInited
+	}
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	client, ok := c.client.(RedisBatchClient)
+	if !ok {
+		return mgetEach(keys, func(key string) ([]byte, int, error) {
+			val, err := c.GetCtx(ctx, key)
+			return val, 0, err
+		})
+	}
+	if _, ok := c.client.(*redis.ClusterClient); ok {
+		return c.mgetPipelined(ctx, client, keys, false)
 	}
 
+	ctx, sp := startDBBatchSpan(ctx, c.Tracer, "redis", "MGET", len(keys))
 	start := time.Now()
-	cmd := c.client.Get(c.ctx, string(key))
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
-	res, err := cmd.Bytes()
+	vals, err := client.MGet(ctx, keys...).Result()
+	sp.end(err)
 	if err != nil {
-		if err == redis.Nil {
-			atomic.AddUint32(&c.misses, 1)
-			return nil, ErrMiss
+		c.doneBatch(opGet, start, 0, 0, err)
+		return nil, nil, err
+	}
+
+	items := make([]Item, 0, len(keys))
+	var misses []string
+	for ix, val := range vals {
+		s, ok := val.(string)
+		if !ok {
+			misses = append(misses, keys[ix])
+			continue
 		}
-		return nil, err
+		items = append(items, Item{Key: keys[ix], Value: []byte(s)})
 	}
-	atomic.AddUint32(&c.hits, 1)
-	return res, nil
+	c.doneBatch(opGet, start, len(items), len(misses), nil)
+	return items, misses, nil
 }
 
-func (c *Rediscacher) BGetWithTTL(key []byte) ([]byte, int, error) {
+func (c *Rediscacher) MGetWithTTL(keys []string) ([]Item, []string, error) {
+	return c.MGetWithTTLCtx(context.Background(), keys)
+}
+
+func (c *Rediscacher) MGetWithTTLCtx(ctx context.Context, keys []string) ([]Item, []string, error) {
 	if !c.inited {
-		return nil, 0, ErrNotInited
+		return nil, nil, ErrNotInited
+	}
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	client, ok := c.client.(RedisBatchClient)
+	if !ok {
+		return mgetEach(keys, func(key string) ([]byte, int, error) {
+			return c.GetWithTTLCtx(ctx, key)
+		})
+	}
+	return c.mgetPipelined(ctx, client, keys, true)
+}
+
+func (c *Rediscacher) mgetPipelined(ctx context.Context, client RedisBatchClient, keys []string, withTTL bool) ([]Item, []string, error) {
+	ctx, sp := startDBBatchSpan(ctx, c.Tracer, "redis", "GET", len(keys))
+	pipe := client.Pipeline()
+	gets := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for ix, key := range keys {
+		gets[ix] = pipe.Get(ctx, key)
+		if withTTL {
+			ttls[ix] = pipe.TTL(ctx, key)
+		}
 	}
-	skey := string(key)
 	start := time.Now()
-	res, err := c.client.Get(c.ctx, skey).Bytes()
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
+	_, err := pipe.Exec(ctx)
+	// redis.Nil of missed keys is reported as the pipeline error too
+	if err == redis.Nil {
+		err = nil
+	}
+	sp.end(err)
 	if err != nil {
-		if err == redis.Nil {
-			atomic.AddUint32(&c.misses, 1)
-			return nil, 0, ErrMiss
-		}
-		return nil, 0, err
+		c.doneBatch(opGet, start, 0, 0, err)
+		return nil, nil, err
 	}
 
-	start = time.Now()
-	cmd := c.client.TTL(c.ctx, skey)
-	c.requestCount += 1
-	c.requestTimeSum += time.Since(start).Seconds()
-	if cmd.Err() != nil {
-		return nil, 0, cmd.Err()
+	items := make([]Item, 0, len(keys))
+	var misses []string
+	for ix, cmd := range gets {
+		val, err := cmd.Bytes()
+		if err == redis.Nil {
+			misses = append(misses, keys[ix])
+			continue
+		}
+		if err != nil {
+			c.doneBatch(opGet, start, 0, 0, err)
+			return nil, nil, err
+		}
+		item := Item{Key: keys[ix], Value: val}
+		if withTTL {
+			item.TTL = int(ttls[ix].Val().Seconds())
+		}
+		items = append(items, item)
 	}
-	ttl := int(cmd.Val().Seconds())
+	c.doneBatch(opGet, start, len(items), len(misses), nil)
+	return items, misses, nil
+}
 
-	atomic.AddUint32(&c.hits, 1)
-	return res, ttl, nil
+func (c *Rediscacher) MSet(items []Item) error {
+	return c.MSetCtx(context.Background(), items)
 }
 
-func (c *Rediscacher) BDel(key []byte) error {
+func (c *Rediscacher) MSetCtx(ctx context.Context, items []Item) error {
 	if !c.inited {
 		return ErrNotInited
 	}
-
-	res, err := c.client.Del(c.ctx, string(key)).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return ErrMiss
-		}
-		return err
+	if len(items) == 0 {
+		return nil
 	}
-	if res == 0 {
-		return ErrMiss
+	client, ok := c.client.(RedisBatchClient)
+	if !ok {
+		return msetEach(items, func(key string, payload []byte, ttl int) error {
+			return c.SetCtx(ctx, key, payload, ttl)
+		})
 	}
-
-	return nil
+	ctx, sp := startDBBatchSpan(ctx, c.Tracer, "redis", "SET", len(items))
+	pipe := client.Pipeline()
+	for _, item := range items {
+		ttl := c.Jitter.stringTTL(item.Key, item.TTL)
+		pipe.Set(ctx, item.Key, item.Value, time.Duration(ttl*int(time.Second)))
+	}
+	start := time.Now()
+	_, err := pipe.Exec(ctx)
+	c.doneBatch(opSet, start, 0, 0, err)
+	sp.end(err)
+	return err
 }
 
-func (c *Rediscacher) GetHits() uint32 {
-	return atomic.LoadUint32(&c.hits)
+func (c *Rediscacher) MDel(keys []string) error {
+	return c.MDelCtx(context.Background(), keys)
 }
 
-func (c *Rediscacher) GetMisses() uint32 {
-	return atomic.LoadUint32(&c.misses)
+func (c *Rediscacher) MDelCtx(ctx context.Context, keys []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	client, ok := c.client.(RedisBatchClient)
+	if !ok {
+		return mdelEach(keys, func(key string) error {
+			return c.DelCtx(ctx, key)
+		})
+	}
+	ctx, sp := startDBBatchSpan(ctx, c.Tracer, "redis", "DEL", len(keys))
+	pipe := client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	start := time.Now()
+	_, err := pipe.Exec(ctx)
+	c.doneBatch(opDel, start, 0, 0, err)
+	sp.end(err)
+	return err
 }
 
 func (c *Rediscacher) Close() {
 	if !c.inited {
 		return
 	}
+	if c.tracking != nil {
+		c.tracking.close()
+		c.tracking = nil
+	}
 	c.client.Close()
 	c.inited = false
 }
 
-func (c *Rediscacher) Reset() {}
+// Reset resets the statistics only, the data in redis is kept
+func (c *Rediscacher) Reset() {
+	c.resetStats()
+}
 
+// GetAvgRequestTime returns the mean time of a request in seconds
 func (c *Rediscacher) GetAvgRequestTime() float64 {
-	if c.requestCount == 0 {
-		return 0.
-	}
-	return c.requestTimeSum / float64(c.requestCount)
+	return c.avgRequestTime()
 }
@@ -0,0 +1,143 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// channel of invalidation messages of server-assisted client-side caching
+const REDIS_INVALIDATE_CHANNEL = "__redis__:invalidate"
+
+// a silent tracking connection is checked by a ping after the interval
+const trackingPingInterval = 30 * time.Second
+
+// redisTracking listens to invalidations of keys with the prefixes and deletes them from the local cacher.
+// RESP2 connection can get invalidations only as pub/sub messages, so a dedicated connection
+// enables tracking in broadcasting mode redirected to itself and then subscribes to the channel
+type redisTracking struct {
+	local    Cacher
+	prefixes []string
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	connects int32
+}
+
+// EnableTracking turns on redis server-assisted client-side caching in broadcasting mode: every change
+// of a key starting with one of the prefixes, made by any redis client, deletes the key from local.
+// No prefixes means all keys. Invalidations sent while the tracking connection reconnects are lost,
+// so local is reset on every reconnect, FLUSHDB and FLUSHALL reset it too. Cluster mode is not supported.
+// Tracking does not order invalidations with backfills: a lookup reading the old value from redis
+// right before a change may backfill it into local after the invalidation of the change has been
+// applied, then local keeps the old value until its TTL. Keep TTLs of local short or disable backfill
+// of local by BACKFILL_SKIP or BACKFILL_CAP if such windows are not acceptable
+func (c *Rediscacher) EnableTracking(local Cacher, prefixes ...string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	if c.tracking != nil {
+		return fmt.Errorf("tracking is already enabled")
+	}
+	client, ok := c.client.(*redis.Client)
+	if !ok {
+		return fmt.Errorf("tracking is supported by a single node redis client only")
+	}
+	t := &redisTracking{
+		local:    local,
+		prefixes: prefixes,
+	}
+	opt := *client.Options()
+	opt.PoolSize = 1
+	opt.MinIdleConns = 0
+	opt.OnConnect = t.onConnect(opt.OnConnect)
+	t.client = redis.NewClient(&opt)
+
+	ctx := context.Background()
+	t.pubsub = t.client.Subscribe(ctx, REDIS_INVALIDATE_CHANNEL)
+	if _, err := t.pubsub.Receive(ctx); err != nil {
+		t.close()
+		return err
+	}
+	go t.listen()
+	c.tracking = t
+	return nil
+}
+
+// onConnect enables tracking on every new connection before it subscribes, next is the hook of the client
+func (t *redisTracking) onConnect(next func(ctx context.Context, cn *redis.Conn) error) func(ctx context.Context, cn *redis.Conn) error {
+	return func(ctx context.Context, cn *redis.Conn) error {
+		if next != nil {
+			if err := next(ctx, cn); err != nil {
+				return err
+			}
+		}
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		args := []interface{}{"client", "tracking", "on", "redirect", id, "bcast"}
+		for _, prefix := range t.prefixes {
+			args = append(args, "prefix", prefix)
+		}
+		if err := cn.Process(ctx, redis.NewCmd(ctx, args...)); err != nil {
+			return err
+		}
+		if atomic.AddInt32(&t.connects, 1) > 1 {
+			t.local.Reset()
+		}
+		return nil
+	}
+}
+
+// listen receives invalidations until the tracking connection is closed. go-redis fails to parse
+// the null invalidation of FLUSHDB and FLUSHALL, so messages are received directly instead of
+// by the channel of pubsub, which would drop it
+func (t *redisTracking) listen() {
+	ctx := context.Background()
+	failures := 0
+	for {
+		msg, err := t.pubsub.ReceiveTimeout(ctx, trackingPingInterval)
+		if err != nil {
+			if err == redis.ErrClosed {
+				return
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				// a broken connection fails the ping and is reconnected by the next receive
+				t.pubsub.Ping(ctx)
+				continue
+			}
+			// an unreadable message may be the flush or any lost invalidation, nothing in local is trusted
+			t.local.Reset()
+			if failures > 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			failures++
+			continue
+		}
+		failures = 0
+		if msg, ok := msg.(*redis.Message); ok {
+			t.invalidate(msg)
+		}
+	}
+}
+
+func (t *redisTracking) invalidate(msg *redis.Message) {
+	switch {
+	case len(msg.PayloadSlice) > 0:
+		t.local.MDel(msg.PayloadSlice)
+	case msg.Payload != "":
+		t.local.Del(msg.Payload)
+	default:
+		// the null invalidation of FLUSHDB and FLUSHALL drops every key
+		t.local.Reset()
+	}
+}
+
+func (t *redisTracking) close() {
+	t.pubsub.Close()
+	t.client.Close()
+}
@@ -0,0 +1,80 @@
+package chaincache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// KeyLoader computes the value of the key with TTLs for every level of the chain,
+// it may return ErrNegativeHit to cache the key as not existing
+type KeyLoader func(key string) ([]byte, []int, error)
+
+// Revalidation turns ChainCache into stale-while-revalidate and refresh-ahead mode.
+// Entries are stored with soft expiration SoftTTL seconds after Set. A stale entry is still
+// returned by Get until its hard TTL in the cacher passes, but the first Get after soft
+// expiration starts a background refresh of the key through Loader. RefreshAhead starts
+// the refresh when the rest of the hard TTL of the found entry drops to RefreshAhead seconds.
+// Only one refresh of a key runs at a time, concurrent GetOrLoad of the key joins it
+type Revalidation struct {
+	Loader       KeyLoader
+	SoftTTL      int
+	RefreshAhead int
+}
+
+// revalidate starts the refresh of the key if its entry needs one
+func (c *ChainCache) revalidate(key chainKey, e *entry, ttl int) {
+	rv := c.Revalidation
+	if rv == nil || rv.Loader == nil {
+		return
+	}
+	stale := e.stale(time.Now().Unix())
+	if stale {
+		atomic.AddUint64(&c.staleHits, 1)
+	}
+	ahead := rv.RefreshAhead > 0 && ttl > 0 && ttl <= rv.RefreshAhead
+	if !stale && !ahead {
+		return
+	}
+
+	skey := key.String()
+	// the refreshed entry keeps the tags of the stale one, so InvalidateTag still drops it
+	tags := e.tagNames()
+	// Close waits for the refresh, joining a running one is waited for too
+	c.refreshMu.Lock()
+	if c.closing {
+		c.refreshMu.Unlock()
+		return
+	}
+	c.refreshing.Add(1)
+	c.refreshMu.Unlock()
+	done := c.loads.DoChan(skey, func() (interface{}, error) {
+		atomic.AddUint64(&c.refreshes, 1)
+		val, err := c.load(skey, func() ([]byte, []int, []string, error) {
+			val, ttls, err := rv.Loader(skey)
+			return val, ttls, tags, err
+		})
+		if err != nil && err != ErrNegativeHit {
+			atomic.AddUint64(&c.refreshErrors, 1)
+		}
+		return val, err
+	})
+	go func() {
+		<-done
+		c.refreshing.Done()
+	}()
+}
+
+// GetStaleHits returns the number of stale entries returned by the chain
+func (c *ChainCache) GetStaleHits() uint64 {
+	return atomic.LoadUint64(&c.staleHits)
+}
+
+// GetRefreshes returns the number of background refreshes started by the chain
+func (c *ChainCache) GetRefreshes() uint64 {
+	return atomic.LoadUint64(&c.refreshes)
+}
+
+// GetRefreshErrors returns the number of background refreshes failed by the loader or the chain
+func (c *ChainCache) GetRefreshErrors() uint64 {
+	return atomic.LoadUint64(&c.refreshErrors)
+}
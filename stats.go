@@ -0,0 +1,364 @@
+package chaincache
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Latency is a summary of a latency histogram, percentiles are accurate to 1/4 of their value
+type Latency struct {
+	// total time of all operations
+	Total time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// OpStats are counters of one kind of cacher operations, a batch operation counts once
+type OpStats struct {
+	Count   uint64
+	Errors  uint64
+	Latency Latency
+}
+
+// AvgLatency returns the mean time of an operation
+func (s OpStats) AvgLatency() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Latency.Total / time.Duration(s.Count)
+}
+
+// CacherStats is a snapshot of cacher counters, hits and misses are counted by keys
+type CacherStats struct {
+	Hits   uint64
+	Misses uint64
+	Get    OpStats
+	Set    OpStats
+	Del    OpStats
+}
+
+// LevelStats are counters of one level of a chain
+type LevelStats struct {
+	// keys found on the level
+	Hits uint64
+	// keys missed on the level
+	Misses uint64
+	// errors of the level swallowed by IgnoreErrors
+	Errors uint64
+	// values written to the level from deeper ones
+	Backfills uint64
+	// values failed to be written back
+	BackfillErrors uint64
+	// lookups sent to the level, a batch lookup counts once
+	Requests uint64
+	// time of lookups
+	Latency Latency
+}
+
+// AvgLatency returns the mean time of a lookup on the level
+func (s LevelStats) AvgLatency() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.Latency.Total / time.Duration(s.Requests)
+}
+
+// ChainStats is a snapshot of chain counters, Levels are in the order of the chain
+type ChainStats struct {
+	Hits              uint64
+	Misses            uint64
+	NegativeHits      uint64
+	NegativeBackfills uint64
+	StaleHits         uint64
+	Refreshes         uint64
+	RefreshErrors     uint64
+	EarlyRefreshes    uint64
+	// keys evicted from local levels by messages of other chains
+	Invalidations uint64
+	// entries found on a level with an invalidated tag, they count as misses of the level
+	TagMisses uint64
+	// changes waiting in the write-behind queues
+	WriteBehindQueue uint64
+	// changes dropped by the backpressure policy of full write-behind queues
+	WriteBehindDropped uint64
+	// background writes failed after all retries, counted per level
+	WriteBehindFailed uint64
+	Levels            []LevelStats
+}
+
+// Stats returns the current chain counters, counters are read one by one,
+// so the snapshot is not atomic as a whole
+func (c *ChainCache) Stats() ChainStats {
+	s := ChainStats{
+		Hits:               atomic.LoadUint64(&c.hits),
+		Misses:             atomic.LoadUint64(&c.misses),
+		NegativeHits:       atomic.LoadUint64(&c.negativeHits),
+		NegativeBackfills:  atomic.LoadUint64(&c.negativeBackfills),
+		StaleHits:          atomic.LoadUint64(&c.staleHits),
+		Refreshes:          atomic.LoadUint64(&c.refreshes),
+		RefreshErrors:      atomic.LoadUint64(&c.refreshErrors),
+		EarlyRefreshes:     atomic.LoadUint64(&c.earlyRefreshes),
+		Invalidations:      atomic.LoadUint64(&c.invalidations),
+		TagMisses:          atomic.LoadUint64(&c.tagMisses),
+		WriteBehindDropped: atomic.LoadUint64(&c.writeBehindDropped),
+		WriteBehindFailed:  atomic.LoadUint64(&c.writeBehindFailed),
+		Levels:             make([]LevelStats, len(c.levels)),
+	}
+	if wb := c.writeBehind; wb != nil {
+		s.WriteBehindQueue = uint64(wb.depth())
+	}
+	for ix := range c.levels {
+		s.Levels[ix] = c.levels[ix].snapshot()
+	}
+	return s
+}
+
+// every power of two is split into 1<<histSubBits buckets
+const (
+	histSubBits = 2
+	histBuckets = (64 - histSubBits + 1) << histSubBits
+)
+
+// latencyHistogram is a lock-free histogram of durations in log-linear nanosecond buckets
+type latencyHistogram struct {
+	sum     uint64
+	buckets [histBuckets]uint64
+}
+
+func histBucket(ns uint64) int {
+	if ns < 1<<histSubBits {
+		return int(ns)
+	}
+	exp := bits.Len64(ns) - 1
+	sub := int(ns>>(exp-histSubBits)) & (1<<histSubBits - 1)
+	return (exp-histSubBits+1)<<histSubBits + sub
+}
+
+// histBounds returns the lowest value of the bucket and its width
+func histBounds(bucket int) (uint64, uint64) {
+	if bucket < 1<<histSubBits {
+		return uint64(bucket), 1
+	}
+	exp := bucket>>histSubBits + histSubBits - 1
+	sub := uint64(bucket & (1<<histSubBits - 1))
+	width := uint64(1) << (exp - histSubBits)
+	return uint64(1)<<exp + sub*width, width
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddUint64(&h.sum, uint64(d))
+	atomic.AddUint64(&h.buckets[histBucket(uint64(d))], 1)
+}
+
+func (h *latencyHistogram) snapshot() Latency {
+	var (
+		counts [histBuckets]uint64
+		total  uint64
+	)
+	for ix := range h.buckets {
+		counts[ix] = atomic.LoadUint64(&h.buckets[ix])
+		total += counts[ix]
+	}
+	return Latency{
+		Total: time.Duration(atomic.LoadUint64(&h.sum)),
+		P50:   quantile(&counts, total, 0.5),
+		P95:   quantile(&counts, total, 0.95),
+		P99:   quantile(&counts, total, 0.99),
+	}
+}
+
+// quantile interpolates the value of rank q inside its bucket
+func quantile(counts *[histBuckets]uint64, total uint64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen uint64
+	for ix, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if float64(seen+n) >= rank {
+			low, width := histBounds(ix)
+			part := (rank - float64(seen)) / float64(n)
+			return time.Duration(float64(low) + part*float64(width))
+		}
+		seen += n
+	}
+	return 0
+}
+
+func (h *latencyHistogram) reset() {
+	atomic.StoreUint64(&h.sum, 0)
+	for ix := range h.buckets {
+		atomic.StoreUint64(&h.buckets[ix], 0)
+	}
+}
+
+// cacher operations of statistics
+const (
+	opGet = iota
+	opSet
+	opDel
+	opKinds
+)
+
+type opStats struct {
+	count   uint64
+	errors  uint64
+	latency latencyHistogram
+}
+
+func (s *opStats) snapshot() OpStats {
+	return OpStats{
+		Count:   atomic.LoadUint64(&s.count),
+		Errors:  atomic.LoadUint64(&s.errors),
+		Latency: s.latency.snapshot(),
+	}
+}
+
+// cacherStats is embedded into cachers to count their operations, it has to be
+// the first field of a cacher to keep 64-bit counters aligned on 32-bit platforms
+type cacherStats struct {
+	hits   uint64
+	misses uint64
+	ops    [opKinds]opStats
+}
+
+// done counts the operation started at start, ErrMiss is a miss of get and not an error at all for del
+func (s *cacherStats) done(op int, start time.Time, err error) {
+	switch {
+	case err == nil || err == ErrNegativeHit:
+		if op == opGet {
+			atomic.AddUint64(&s.hits, 1)
+		}
+	case err == ErrMiss:
+		if op == opGet {
+			atomic.AddUint64(&s.misses, 1)
+		}
+	default:
+		atomic.AddUint64(&s.ops[op].errors, 1)
+	}
+	atomic.AddUint64(&s.ops[op].count, 1)
+	s.ops[op].latency.observe(time.Since(start))
+}
+
+// doneBatch counts the batch operation started at start with the number of found and missed keys
+func (s *cacherStats) doneBatch(op int, start time.Time, hits int, misses int, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.ops[op].errors, 1)
+	}
+	if hits > 0 {
+		atomic.AddUint64(&s.hits, uint64(hits))
+	}
+	if misses > 0 {
+		atomic.AddUint64(&s.misses, uint64(misses))
+	}
+	atomic.AddUint64(&s.ops[op].count, 1)
+	s.ops[op].latency.observe(time.Since(start))
+}
+
+func (s *cacherStats) GetHits() uint64 {
+	return atomic.LoadUint64(&s.hits)
+}
+
+func (s *cacherStats) GetMisses() uint64 {
+	return atomic.LoadUint64(&s.misses)
+}
+
+// Stats returns the current counters of the cacher
+func (s *cacherStats) Stats() CacherStats {
+	return CacherStats{
+		Hits:   atomic.LoadUint64(&s.hits),
+		Misses: atomic.LoadUint64(&s.misses),
+		Get:    s.ops[opGet].snapshot(),
+		Set:    s.ops[opSet].snapshot(),
+		Del:    s.ops[opDel].snapshot(),
+	}
+}
+
+// avgRequestTime returns the mean time of all operations in seconds
+func (s *cacherStats) avgRequestTime() float64 {
+	var (
+		count uint64
+		sum   uint64
+	)
+	for ix := range s.ops {
+		count += atomic.LoadUint64(&s.ops[ix].count)
+		sum += atomic.LoadUint64(&s.ops[ix].latency.sum)
+	}
+	if count == 0 {
+		return 0.
+	}
+	return time.Duration(sum / count).Seconds()
+}
+
+func (s *cacherStats) resetStats() {
+	atomic.StoreUint64(&s.hits, 0)
+	atomic.StoreUint64(&s.misses, 0)
+	for ix := range s.ops {
+		atomic.StoreUint64(&s.ops[ix].count, 0)
+		atomic.StoreUint64(&s.ops[ix].errors, 0)
+		s.ops[ix].latency.reset()
+	}
+}
+
+type levelStats struct {
+	hits           uint64
+	misses         uint64
+	errors         uint64
+	backfills      uint64
+	backfillErrors uint64
+	requests       uint64
+	latency        latencyHistogram
+}
+
+func (s *levelStats) lookup(start time.Time, hits int, misses int) {
+	atomic.AddUint64(&s.requests, 1)
+	s.latency.observe(time.Since(start))
+	if hits > 0 {
+		atomic.AddUint64(&s.hits, uint64(hits))
+	}
+	if misses > 0 {
+		atomic.AddUint64(&s.misses, uint64(misses))
+	}
+}
+
+func (s *levelStats) backfill(n int, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.backfillErrors, uint64(n))
+	} else {
+		atomic.AddUint64(&s.backfills, uint64(n))
+	}
+}
+
+func (s *levelStats) swallowed() {
+	atomic.AddUint64(&s.errors, 1)
+}
+
+func (s *levelStats) snapshot() LevelStats {
+	return LevelStats{
+		Hits:           atomic.LoadUint64(&s.hits),
+		Misses:         atomic.LoadUint64(&s.misses),
+		Errors:         atomic.LoadUint64(&s.errors),
+		Backfills:      atomic.LoadUint64(&s.backfills),
+		BackfillErrors: atomic.LoadUint64(&s.backfillErrors),
+		Requests:       atomic.LoadUint64(&s.requests),
+		Latency:        s.latency.snapshot(),
+	}
+}
+
+func (s *levelStats) reset() {
+	atomic.StoreUint64(&s.hits, 0)
+	atomic.StoreUint64(&s.misses, 0)
+	atomic.StoreUint64(&s.errors, 0)
+	atomic.StoreUint64(&s.backfills, 0)
+	atomic.StoreUint64(&s.backfillErrors, 0)
+	atomic.StoreUint64(&s.requests, 0)
+	s.latency.reset()
+}
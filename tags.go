@@ -0,0 +1,310 @@
+package chaincache
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// prefix of the keys of tag versions in the last level of a chain
+	TAG_KEY_PREFIX = "chaincache:tag:"
+	// TTL of tag versions when TagTTL of the chain is not set
+	DEFAULT_TAG_TTL = 24 * 60 * 60
+)
+
+// versions of group prefixes are kept as versions of tags named by the mark and the prefix,
+// tags of SetWithTags cannot start with the mark
+const prefixTagMark = "\x00"
+
+func tagKey(tag string) string {
+	return TAG_KEY_PREFIX + tag
+}
+
+func prefixTag(prefix string) string {
+	return prefixTagMark + prefix
+}
+
+// newTagVersion returns a version distinct from the previous versions of a tag
+func newTagVersion() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+func encodeTagVersion(version uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, version)
+	return buf
+}
+
+// SetWithTags is Set stamping the entry with the current versions of tags. InvalidateTag of any
+// of the tags turns the entry into a miss on every level, so a group of keys can be dropped
+// without enumerating them. Versions are kept in the last level of the chain, it has to be shared
+// by all instances. Tags without a version get one, it is stored with TagTTL
+func (c *ChainCache) SetWithTags(key string, payload []byte, ttlSeconds []int, tags ...string) error {
+	return c.setWithTags(context.Background(), stringKey(key), payload, ttlSeconds, tags)
+}
+
+func (c *ChainCache) SetWithTagsCtx(ctx context.Context, key string, payload []byte, ttlSeconds []int, tags ...string) error {
+	return c.setWithTags(ctx, stringKey(key), payload, ttlSeconds, tags)
+}
+
+// InvalidateTag drops all entries stored with the tag by bumping its version
+func (c *ChainCache) InvalidateTag(tag string) error {
+	return c.InvalidateTagCtx(context.Background(), tag)
+}
+
+func (c *ChainCache) InvalidateTagCtx(ctx context.Context, tag string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	return c.tagLevel().SetCtx(ctx, tagKey(tag), encodeTagVersion(newTagVersion()), c.tagTTL())
+}
+
+// InvalidatePrefix drops all entries of keys starting with the prefix, it has to be one of GroupPrefixes
+func (c *ChainCache) InvalidatePrefix(prefix string) error {
+	return c.InvalidatePrefixCtx(context.Background(), prefix)
+}
+
+func (c *ChainCache) InvalidatePrefixCtx(ctx context.Context, prefix string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	for _, group := range c.GroupPrefixes {
+		if group == prefix {
+			return c.InvalidateTagCtx(ctx, prefixTag(prefix))
+		}
+	}
+	return fmt.Errorf("prefix %q is not one of GroupPrefixes", prefix)
+}
+
+func (c *ChainCache) setWithTags(ctx context.Context, key chainKey, payload []byte, ttlSeconds []int, tags []string) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	stamps, err := c.tagStamps(ctx, tags)
+	if err != nil {
+		return err
+	}
+	return c.setRaw(ctx, key, c.encodeTagged(payload, 0, stamps), ttlSeconds)
+}
+
+// tagStamps checks the tags passed by the caller and returns their current versions
+func (c *ChainCache) tagStamps(ctx context.Context, tags []string) ([]entryTag, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	if len(tags) > 0xFFFF {
+		return nil, fmt.Errorf("too many tags")
+	}
+	for _, tag := range tags {
+		if len(tag) > 0xFFFF {
+			return nil, fmt.Errorf("tag %q... is too long", tag[:32])
+		}
+		if strings.HasPrefix(tag, prefixTagMark) {
+			return nil, fmt.Errorf("tag %q starts with a reserved byte", tag)
+		}
+	}
+	return c.stampTags(ctx, tags)
+}
+
+// tagNames returns the tags the entry has been stored with by the caller, versions of group
+// prefixes are stamped again by every write
+func (e *entry) tagNames() []string {
+	var names []string
+	for _, tag := range e.tags {
+		if !strings.HasPrefix(tag.name, prefixTagMark) {
+			names = append(names, tag.name)
+		}
+	}
+	return names
+}
+
+// stampTags returns the current versions of the tags, tags without a version get one
+func (c *ChainCache) stampTags(ctx context.Context, tags []string) ([]entryTag, error) {
+	versions, err := c.tagVersions(ctx, tags)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make([]entryTag, len(tags))
+	var created []Item
+	for ix, tag := range tags {
+		version, ok := versions[tag]
+		if !ok {
+			version = newTagVersion()
+			versions[tag] = version
+			created = append(created, Item{Key: tagKey(tag), Value: encodeTagVersion(version), TTL: c.tagTTL()})
+		}
+		stamps[ix] = entryTag{name: tag, version: version}
+	}
+	if len(created) > 0 {
+		if err := c.tagLevel().MSetCtx(ctx, created); err != nil {
+			return nil, err
+		}
+	}
+	return stamps, nil
+}
+
+// groupTags returns tags of the group prefixes the key starts with
+func (c *ChainCache) groupTags(key string) []string {
+	var tags []string
+	for _, prefix := range c.GroupPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			tags = append(tags, prefixTag(prefix))
+		}
+	}
+	return tags
+}
+
+// stampGroups adds versions of the group prefixes of the key to the encoded data
+func (c *ChainCache) stampGroups(ctx context.Context, key string, data []byte) ([]byte, error) {
+	tags := c.groupTags(key)
+	if len(tags) == 0 {
+		return data, nil
+	}
+	stamps, err := c.stampTags(ctx, tags)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := decodeEntry(data)
+	if !ok {
+		e = entry{payload: data}
+	}
+	e.flags |= entryTags
+	e.tags = append(e.tags, stamps...)
+	return e.encode(), nil
+}
+
+// stampGroupItems is stampGroups of the items encoded for every level
+func (c *ChainCache) stampGroupItems(ctx context.Context, levels [][]Item) error {
+	if len(c.GroupPrefixes) == 0 {
+		return nil
+	}
+	for i, item := range levels[0] {
+		data, err := c.stampGroups(ctx, item.Key, item.Value)
+		if err != nil {
+			return err
+		}
+		for ix := range levels {
+			levels[ix][i].Value = data
+		}
+	}
+	return nil
+}
+
+func (c *ChainCache) tagTTL() int {
+	if c.TagTTL > 0 {
+		return c.TagTTL
+	}
+	return DEFAULT_TAG_TTL
+}
+
+func (c *ChainCache) tagLevel() ContextCacher {
+	return c.chain[len(c.chain)-1]
+}
+
+// tagVersions returns the current versions of the tags, tags without a version are absent
+func (c *ChainCache) tagVersions(ctx context.Context, tags []string) (map[string]uint64, error) {
+	versions := make(map[string]uint64, len(tags))
+	if len(tags) == 0 {
+		return versions, nil
+	}
+	keys := make([]string, len(tags))
+	for ix, tag := range tags {
+		keys[ix] = tagKey(tag)
+	}
+	items, _, err := c.tagLevel().MGetCtx(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if len(item.Value) == 8 {
+			versions[item.Key[len(TAG_KEY_PREFIX):]] = binary.BigEndian.Uint64(item.Value)
+		}
+	}
+	return versions, nil
+}
+
+// tagsMatch reports if every tag of the entry still has the version the entry was stored with
+func (e *entry) tagsMatch(versions map[string]uint64) bool {
+	for _, tag := range e.tags {
+		if version, ok := versions[tag.name]; !ok || version != tag.version {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTags reports if the tags of the value are still valid, a failure to get the versions
+// invalidates the entry when IgnoreErrors is set
+func (c *ChainCache) checkTags(ctx context.Context, val []byte) (bool, error) {
+	e, ok := decodeEntry(val)
+	if !ok || len(e.tags) == 0 {
+		return true, nil
+	}
+	names := make([]string, len(e.tags))
+	for ix, tag := range e.tags {
+		names[ix] = tag.name
+	}
+	versions, err := c.tagVersions(ctx, names)
+	if err != nil {
+		c.notifyError(len(c.chain)-1, "tags", err)
+		if !c.IgnoreErrors {
+			return false, err
+		}
+		return false, nil
+	}
+	if !e.tagsMatch(versions) {
+		atomic.AddUint64(&c.tagMisses, 1)
+		return false, nil
+	}
+	return true, nil
+}
+
+// dropInvalidated splits found items into ones with valid tags and keys of invalidated ones
+func (c *ChainCache) dropInvalidated(ctx context.Context, items []Item) ([]Item, []string, error) {
+	var (
+		names []string
+		seen  map[string]bool
+	)
+	for _, item := range items {
+		if e, ok := decodeEntry(item.Value); ok && len(e.tags) > 0 {
+			if seen == nil {
+				seen = make(map[string]bool)
+			}
+			for _, tag := range e.tags {
+				if !seen[tag.name] {
+					seen[tag.name] = true
+					names = append(names, tag.name)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return items, nil, nil
+	}
+	versions, err := c.tagVersions(ctx, names)
+	if err != nil {
+		c.notifyError(len(c.chain)-1, "tags", err)
+		if !c.IgnoreErrors {
+			return nil, nil, err
+		}
+		// nothing can be checked, so every tagged item is dropped
+		versions = nil
+	}
+	valid := items[:0:0]
+	var dropped []string
+	for _, item := range items {
+		if e, ok := decodeEntry(item.Value); ok && !e.tagsMatch(versions) {
+			dropped = append(dropped, item.Key)
+			continue
+		}
+		valid = append(valid, item)
+	}
+	if versions != nil {
+		atomic.AddUint64(&c.tagMisses, uint64(len(dropped)))
+	}
+	return valid, dropped, nil
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+func TestChainCacheBackfillPolicy(t *testing.T) {
+	fcs := make([]*chaincache.Freecacher, 4)
+	cachers := make([]chaincache.Cacher, 4)
+	for ix := range fcs {
+		fcs[ix], _ = chaincache.NewFreeCacher(1024 * 1024 * 10)
+		cachers[ix] = fcs[ix]
+	}
+	chain, _ := chaincache.NewChainCache(cachers...)
+	chain.Backfill = []chaincache.BackfillPolicy{
+		{Mode: chaincache.BACKFILL_CAP, TTL: 10},
+		{Mode: chaincache.BACKFILL_FIXED, TTL: 30},
+		{Mode: chaincache.BACKFILL_SKIP},
+	}
+	// the rest of TTL is counted in whole seconds, a second boundary may pass since the backfill
+	checkTTL := func(fc *chaincache.Freecacher, key string, expected int) {
+		_, ttl, err := fc.GetWithTTL(key)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ttl >= expected-1 && ttl <= expected, true, fmt.Sprintf("ttl of %s is %d", key, ttl))
+	}
+
+	fcs[3].Set("key", []byte("value"), 100)
+	checkChainHit(t, chain, "key", []byte("value"))
+	checkTTL(fcs[0], "key", 10)
+	checkTTL(fcs[1], "key", 30)
+	checkMiss(t, fcs[2], "key")
+
+	// the rest of TTL below the cap is kept
+	fcs[3].Set("short", []byte("value"), 5)
+	checkChainHit(t, chain, "short", []byte("value"))
+	checkTTL(fcs[0], "short", 5)
+	checkTTL(fcs[1], "short", 30)
+
+	fcs[3].Set("batch1", []byte("value"), 100)
+	fcs[3].Set("batch2", []byte("value"), 5)
+	_, misses, err := chain.MGet([]string{"batch1", "batch2"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(misses), 0)
+	checkTTL(fcs[0], "batch1", 10)
+	checkTTL(fcs[0], "batch2", 5)
+	checkTTL(fcs[1], "batch1", 30)
+	checkMiss(t, fcs[2], "batch1")
+	assert.Equal(t, chain.Stats().Levels[2].Backfills, uint64(0))
+
+	// background backfill does not block the lookup, the value shows up later
+	chain.AsyncBackfill = true
+	fcs[3].Set("async", []byte("value"), 100)
+	fcs[3].Set("masync", []byte("value"), 100)
+	checkChainHit(t, chain, "async", []byte("value"))
+	_, _, err = chain.MGet([]string{"masync"})
+	assert.Equal(t, err, nil)
+	for _, key := range []string{"async", "masync"} {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := fcs[1].Get(key); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		checkTTL(fcs[0], key, 10)
+		checkTTL(fcs[1], key, 30)
+	}
+	chain.Close()
+}
+
+func TestChainCacheAsyncBackfillCopies(t *testing.T) {
+	local := newGatedCacher(false)
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(local, remote)
+	chain.AsyncBackfill = true
+	remote.Set("key", []byte("value"), 60)
+	remote.Set("batch", []byte("value"), 60)
+
+	// the caller changes the found values while the backfill waits for the level
+	val, err := chain.Get("key")
+	assert.Equal(t, err, nil)
+	<-local.entered
+	copy(val, "xxxxx")
+	items, _, err := chain.MGet([]string{"batch"})
+	assert.Equal(t, err, nil)
+	copy(items[0].Value, "xxxxx")
+	items[0].Key = "other"
+	close(local.gate)
+	deadline := time.Now().Add(time.Second)
+	for _, key := range []string{"key", "batch"} {
+		for time.Now().Before(deadline) {
+			if _, err := local.Get(key); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	checkHit(t, local, "key", []byte("value"))
+	checkHit(t, local, "batch", []byte("value"))
+	checkMiss(t, local, "other")
+	chain.Close()
+}
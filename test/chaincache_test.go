@@ -1,11 +1,15 @@
 package tests
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	redis "github.com/go-redis/redis/v8"
 	"github.com/magiconair/properties/assert"
 	"github.com/n1ord/chaincache"
 )
@@ -36,13 +40,13 @@ func testCacher(t *testing.T, cacher chaincache.Cacher, bigValues bool) {
 			assert.Equal(t, err, nil)
 			checkHit(t, cacher, key, value)
 		}
-		assert.Equal(t, cacher.GetHits(), uint32(N))
+		assert.Equal(t, cacher.GetHits(), uint64(N))
 
 		for i := 0; i < N; i++ {
 			key := fmt.Sprintf("new key %d", i)
 			checkMiss(t, cacher, key)
 		}
-		assert.Equal(t, cacher.GetMisses(), uint32(N))
+		assert.Equal(t, cacher.GetMisses(), uint64(N))
 	}
 
 	{
@@ -94,13 +98,13 @@ func testCacher(t *testing.T, cacher chaincache.Cacher, bigValues bool) {
 			assert.Equal(t, err, nil)
 			checkHit(t, cacher, key, value)
 		}
-		// assert.Equal(t, cacher.GetHits(), uint32(N))
+		// assert.Equal(t, cacher.GetHits(), uint64(N))
 
 		for i := 0; i < n; i++ {
 			key := fmt.Sprintf("new key %d", i)
 			checkMiss(t, cacher, key)
 		}
-		// assert.Equal(t, cacher.GetMisses(), uint32(N))
+		// assert.Equal(t, cacher.GetMisses(), uint64(N))
 	}
 }
 
@@ -116,13 +120,13 @@ func testCacherBytes(t *testing.T, cacher chaincache.Cacher) {
 			assert.Equal(t, err, nil)
 			checkBHit(t, cacher, key, value)
 		}
-		assert.Equal(t, cacher.GetHits(), uint32(N))
+		assert.Equal(t, cacher.GetHits(), uint64(N))
 
 		for i := 0; i < N; i++ {
 			key := []byte(fmt.Sprintf("new key %d", i))
 			checkBMiss(t, cacher, key)
 		}
-		assert.Equal(t, cacher.GetMisses(), uint32(N))
+		assert.Equal(t, cacher.GetMisses(), uint64(N))
 	}
 
 	{
@@ -243,6 +247,13 @@ func TestAerocacher(t *testing.T) {
 		}
 		testCacherBytes(t, ac)
 	}
+	{
+		ac, err := chaincache.NewAerocacher(cfg)
+		if err != nil {
+			panic(err)
+		}
+		testCacherBatch(t, ac)
+	}
 	// fmt.Printf("Cacher avg request time: %fsec\n", ac.GetAvgRequestTime())
 }
 
@@ -267,6 +278,14 @@ func TestRediscacher(t *testing.T) {
 		}
 		testCacherBytes(t, rc)
 	}
+	{
+
+		rc, err := chaincache.NewRediscacher(&cfg)
+		if err != nil {
+			panic(err)
+		}
+		testCacherBatch(t, rc)
+	}
 	// fmt.Printf("Cacher avg request time: %fsec\n", rc.GetAvgRequestTime())
 }
 
@@ -383,17 +402,17 @@ func TestChainCache(t *testing.T) {
 
 		chain.Get("somekeynotexisted")
 
-		assert.Equal(t, fc1.GetHits(), uint32(4))
-		assert.Equal(t, fc1.GetMisses(), uint32(7))
+		assert.Equal(t, fc1.GetHits(), uint64(4))
+		assert.Equal(t, fc1.GetMisses(), uint64(7))
 
-		assert.Equal(t, fc2.GetHits(), uint32(3))
-		assert.Equal(t, fc2.GetMisses(), uint32(7))
+		assert.Equal(t, fc2.GetHits(), uint64(3))
+		assert.Equal(t, fc2.GetMisses(), uint64(7))
 
-		assert.Equal(t, fc3.GetHits(), uint32(7))
-		assert.Equal(t, fc3.GetMisses(), uint32(1))
+		assert.Equal(t, fc3.GetHits(), uint64(7))
+		assert.Equal(t, fc3.GetMisses(), uint64(1))
 
-		assert.Equal(t, chain.GetHits(), uint32(4))
-		assert.Equal(t, chain.GetMisses(), uint32(1))
+		assert.Equal(t, chain.GetHits(), uint64(4))
+		assert.Equal(t, chain.GetMisses(), uint64(1))
 	}
 }
 
@@ -472,16 +491,708 @@ func TestChainCacheBytes(t *testing.T) {
 
 		chain.Get("somekeynotexisted")
 
-		assert.Equal(t, fc1.GetHits(), uint32(4))
-		assert.Equal(t, fc1.GetMisses(), uint32(7))
+		assert.Equal(t, fc1.GetHits(), uint64(4))
+		assert.Equal(t, fc1.GetMisses(), uint64(7))
+
+		assert.Equal(t, fc2.GetHits(), uint64(3))
+		assert.Equal(t, fc2.GetMisses(), uint64(7))
+
+		assert.Equal(t, fc3.GetHits(), uint64(7))
+		assert.Equal(t, fc3.GetMisses(), uint64(1))
 
-		assert.Equal(t, fc2.GetHits(), uint32(3))
-		assert.Equal(t, fc2.GetMisses(), uint32(7))
+		assert.Equal(t, chain.GetHits(), uint64(4))
+		assert.Equal(t, chain.GetMisses(), uint64(1))
+	}
+}
+
+var (
+	_ chaincache.ContextCacher = (*chaincache.Fastcacher)(nil)
+	_ chaincache.ContextCacher = (*chaincache.Freecacher)(nil)
+	_ chaincache.ContextCacher = (*chaincache.Probecacher)(nil)
+	_ chaincache.ContextCacher = (*chaincache.Rediscacher)(nil)
+	_ chaincache.ContextCacher = (*chaincache.Aerocacher)(nil)
+)
+
+func TestChainCacheContext(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	key := "key"
+	value := []byte("value")
+
+	err := chain.SetCtx(context.Background(), key, value, []int{60, 60})
+	assert.Equal(t, err, nil)
+	val, err := chain.GetCtx(context.Background(), key)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, value)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// canceled context is never hidden by IgnoreErrors
+	chain.IgnoreErrors = true
+	val, err = chain.GetCtx(ctx, key)
+	assert.Equal(t, err, context.Canceled)
+	assert.Equal(t, len(val), 0)
+
+	err = chain.BSetCtx(ctx, []byte(key), value, []int{60, 60})
+	assert.Equal(t, err, context.Canceled)
+	err = chain.DelCtx(ctx, key)
+	assert.Equal(t, err, context.Canceled)
+
+	_, err = fc1.GetCtx(ctx, key)
+	assert.Equal(t, err, context.Canceled)
+	checkHit(t, fc1, key, value)
+	assert.Equal(t, chain.GetMisses(), uint64(0))
+}
+
+func TestChainCacheGetOrLoad(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+
+	N := 50
+	var calls int32
+	loader := func() ([]byte, []int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return []byte("loaded"), []int{60, 120}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := chain.GetOrLoad("key", loader)
+			assert.Equal(t, err, nil)
+			assert.Equal(t, val, []byte("loaded"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+
+	checkHit(t, fc1, "key", []byte("loaded"))
+	_, ttl, _ := fc2.GetWithTTL("key")
+	assert.Equal(t, ttl, 120)
+
+	// loader errors reach every waiter and nothing is cached
+	loadErr := fmt.Errorf("origin is down")
+	failing := func() ([]byte, []int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil, loadErr
+	}
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := chain.GetOrLoad("failing", failing)
+			assert.Equal(t, err, loadErr)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+	checkMiss(t, fc2, "failing")
+
+	// waiters give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := chain.GetOrLoadCtx(ctx, "slow", loader)
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
+
+var _ chaincache.ContextCacher = (*chaincache.ChainCacher)(nil)
+
+func TestChainCacher(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc3, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+
+	inner, _ := chaincache.NewChainCache(fc2, fc3)
+	innerCacher := chaincache.NewChainCacher(inner, chaincache.CapTTLPolicy{10})
+	outer, _ := chaincache.NewChainCache(fc1, innerCacher)
+
+	// TTL spreading by policies
+	err := outer.Set("key", []byte("value"), []int{5, 60})
+	assert.Equal(t, err, nil)
+	_, ttl, _ := fc1.GetWithTTL("key")
+	assert.Equal(t, ttl, 5)
+	_, ttl, _ = fc2.GetWithTTL("key")
+	assert.Equal(t, ttl, 10)
+	_, ttl, _ = fc3.GetWithTTL("key")
+	assert.Equal(t, ttl, 60)
+
+	scaled := chaincache.NewChainCacher(inner, chaincache.ScaleTTLPolicy{0.5, 2})
+	err = scaled.Set("scaled", []byte("value"), 30)
+	assert.Equal(t, err, nil)
+	_, ttl, _ = fc2.GetWithTTL("scaled")
+	assert.Equal(t, ttl, 15)
+	_, ttl, _ = fc3.GetWithTTL("scaled")
+	assert.Equal(t, ttl, 60)
+
+	// hit in the deepest level is backfilled through the nested chain
+	err = fc3.Set("deep", []byte("deepvalue"), 40)
+	assert.Equal(t, err, nil)
+	val, ttl, err := outer.GetWithTTL("deep")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("deepvalue"))
+	assert.Equal(t, ttl, 40)
+	_, ttl, _ = fc2.GetWithTTL("deep")
+	assert.Equal(t, ttl, 40)
+	_, ttl, _ = fc1.GetWithTTL("deep")
+	assert.Equal(t, ttl, 40)
+
+	err = outer.Del("deep")
+	assert.Equal(t, err, nil)
+	checkMiss(t, fc1, "deep")
+	checkMiss(t, fc2, "deep")
+	checkMiss(t, fc3, "deep")
+	checkMiss(t, innerCacher, "deep")
+
+	outer.Reset()
+	checkMiss(t, fc3, "key")
+	assert.Equal(t, outer.GetHits(), uint64(0))
+}
+
+func TestChainCacheTTLPolicy(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	levelTTLs := func(key string) []int {
+		_, ttl1, _ := fc1.GetWithTTL(key)
+		_, ttl2, _ := fc2.GetWithTTL(key)
+		return []int{ttl1, ttl2}
+	}
+
+	// without a policy every level gets the same TTL
+	assert.Equal(t, chain.SetTTL("same", []byte("value"), 30), nil)
+	assert.Equal(t, levelTTLs("same"), []int{30, 30})
+
+	chain.TTLPolicy = chaincache.FixedTTLPolicy{10}
+	assert.Equal(t, chain.SetTTL("fixed", []byte("value"), 30), nil)
+	assert.Equal(t, levelTTLs("fixed"), []int{10, 30})
+	// zero TTLs are not configured ones
+	chain.TTLPolicy = chaincache.FixedTTLPolicy{0, 20}
+	assert.Equal(t, chain.SetTTL("partial", []byte("value"), 30), nil)
+	assert.Equal(t, levelTTLs("partial"), []int{30, 20})
+
+	chain.TTLPolicy = chaincache.CapTTLPolicy{10, 20}
+	assert.Equal(t, chain.BSetTTL([]byte("capped"), []byte("value"), 15), nil)
+	assert.Equal(t, levelTTLs("capped"), []int{10, 15})
+
+	chain.TTLPolicy = chaincache.ScaleTTLPolicy{0.5, 2}
+	assert.Equal(t, chain.SetTTLCtx(context.Background(), "scaled", []byte("value"), 30), nil)
+	assert.Equal(t, levelTTLs("scaled"), []int{15, 60})
+
+	// the explicit form ignores the policy
+	assert.Equal(t, chain.Set("explicit", []byte("value"), []int{5, 6}), nil)
+	assert.Equal(t, levelTTLs("explicit"), []int{5, 6})
+
+	chain.TTLPolicy = chaincache.JitterTTLPolicy{Policy: chaincache.FixedTTLPolicy{100}, Percent: 10}
+	for ix := 0; ix < 20; ix++ {
+		key := fmt.Sprintf("jittered%d", ix)
+		assert.Equal(t, chain.SetTTL(key, []byte("value"), 1000), nil)
+		ttls := levelTTLs(key)
+		assert.Equal(t, ttls[0] >= 89 && ttls[0] <= 110, true)
+		assert.Equal(t, ttls[1] >= 899 && ttls[1] <= 1100, true)
+	}
+
+	// ChainCacher without a policy falls back to the policy of the chain
+	chain.TTLPolicy = chaincache.FixedTTLPolicy{10}
+	cacher := chaincache.NewChainCacher(chain, nil)
+	assert.Equal(t, cacher.Set("adapted", []byte("value"), 30), nil)
+	assert.Equal(t, levelTTLs("adapted"), []int{10, 30})
+}
+
+func TestScaleTTLPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy chaincache.ScaleTTLPolicy
+		ttl    int
+		levels int
+		ttls   []int
+	}{
+		{chaincache.ScaleTTLPolicy{0.5, 2}, 30, 2, []int{15, 60}},
+		// small positive TTLs never turn into no expiration
+		{chaincache.ScaleTTLPolicy{0.1, 1}, 5, 2, []int{1, 5}},
+		{chaincache.ScaleTTLPolicy{0.5}, 1, 2, []int{1, 1}},
+		{chaincache.ScaleTTLPolicy{0.01, 0.5}, 3, 3, []int{1, 1, 3}},
+		{chaincache.ScaleTTLPolicy{0.5, 2}, 0, 2, []int{0, 0}},
+	} {
+		assert.Equal(t, tc.policy.LevelTTLs(tc.ttl, tc.levels), tc.ttls)
+	}
+}
+
+func testCacherBatch(t *testing.T, cacher chaincache.Cacher) {
+	N := 20
+	items := make([]chaincache.Item, 0, N)
+	keys := make([]string, 0, 2*N)
+	for i := 0; i < N; i++ {
+		key := fmt.Sprintf("batch %d", i)
+		items = append(items, chaincache.Item{Key: key, Value: []byte(fmt.Sprintf("value %d", i)), TTL: 10})
+		keys = append(keys, key, fmt.Sprintf("batch missed %d", i))
+	}
+	err := cacher.MSet(items)
+	assert.Equal(t, err, nil)
+
+	found, misses, err := cacher.MGet(keys)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), N)
+	assert.Equal(t, len(misses), N)
+	for i, item := range found {
+		assert.Equal(t, item.Key, items[i].Key)
+		assert.Equal(t, item.Value, items[i].Value)
+		assert.Equal(t, misses[i], fmt.Sprintf("batch missed %d", i))
+	}
+
+	found, _, err = cacher.MGetWithTTL(keys[:2])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), 1)
+	assert.Equal(t, found[0].TTL, 10)
+
+	err = cacher.MDel(keys)
+	assert.Equal(t, err, nil)
+	found, misses, err = cacher.MGet(keys)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), 0)
+	assert.Equal(t, len(misses), 2*N)
+}
+
+// mapRedisClient is a redis client without batch requests keeping data in a map, TTLs never expire
+type mapRedisClient struct {
+	data map[string]string
+	ttls map[string]time.Duration
+}
+
+func newMapRedisClient() *mapRedisClient {
+	return &mapRedisClient{data: make(map[string]string), ttls: make(map[string]time.Duration)}
+}
+
+func (c *mapRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
 
-		assert.Equal(t, fc3.GetHits(), uint32(7))
-		assert.Equal(t, fc3.GetMisses(), uint32(1))
+func (c *mapRedisClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
+	c.data[key] = string(value.([]byte))
+	c.ttls[key] = ttl
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *mapRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	val, ok := c.data[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(val, nil)
+}
+
+func (c *mapRedisClient) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	return redis.NewDurationResult(c.ttls[key], nil)
+}
+
+func (c *mapRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	var n int64
+	for _, key := range keys {
+		if _, ok := c.data[key]; ok {
+			delete(c.data, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (c *mapRedisClient) Close() error {
+	return nil
+}
+
+func TestCachersBatch(t *testing.T) {
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		testCacherBatch(t, fc)
+	}
+	{
+		// a client without MGet and Pipeline is asked key by key
+		rc, err := chaincache.NewRediccacherWithClient(newMapRedisClient())
+		assert.Equal(t, err, nil)
+		testCacherBatch(t, rc)
+	}
+	{
+		fc, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+		testCacherBatch(t, fc)
+	}
+	{
+		pc, _ := chaincache.NewProbecacher(10, 1024*1024*50, 1024*1024*65, 6, chaincache.STORAGE_LRU)
+		testCacherBatch(t, pc)
+	}
+}
+
+func TestChainCacheBatch(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc3, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2, fc3)
+
+	fc1.Set("k1", []byte("v1"), 60)
+	fc2.Set("k2", []byte("v2"), 50)
+	fc3.Set("k3", []byte("v3"), 40)
+
+	found, misses, err := chain.MGet([]string{"k1", "k2", "k3", "k4"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), 3)
+	assert.Equal(t, misses, []string{"k4"})
+
+	// every key is asked only until it is found
+	assert.Equal(t, fc1.GetMisses(), uint64(3))
+	assert.Equal(t, fc2.GetMisses(), uint64(2))
+	assert.Equal(t, fc3.GetMisses(), uint64(1))
+
+	// and found keys are backfilled with the rest of their TTL
+	_, ttl, _ := fc1.GetWithTTL("k3")
+	assert.Equal(t, ttl, 40)
+	_, ttl, _ = fc2.GetWithTTL("k3")
+	assert.Equal(t, ttl, 40)
+	_, ttl, _ = fc1.GetWithTTL("k2")
+	assert.Equal(t, ttl, 50)
+	assert.Equal(t, chain.GetHits(), uint64(3))
+	assert.Equal(t, chain.GetMisses(), uint64(1))
+
+	err = chain.MSet([]chaincache.Item{{Key: "k5", Value: []byte("v5")}}, []int{10, 20, 30})
+	assert.Equal(t, err, nil)
+	_, ttl, _ = fc3.GetWithTTL("k5")
+	assert.Equal(t, ttl, 30)
+
+	err = chain.MDel([]string{"k1", "k2", "k3", "k5"})
+	assert.Equal(t, err, nil)
+	checkMiss(t, fc3, "k3")
+	checkMiss(t, fc1, "k5")
+}
+
+func TestChainCacheNegative(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc3, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2, fc3)
+
+	err := chain.SetNegative("absent", []int{60, 60, 60})
+	assert.Equal(t, err, nil)
+	val, err := chain.Get("absent")
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+	assert.Equal(t, len(val), 0)
+
+	// tombstone found deep in the chain stops the lookup and is backfilled
+	fc1.Reset()
+	fc2.Reset()
+	fc3.Reset()
+	chain.Reset()
+	err = chain.BSetNegative([]byte("absent"), []int{60, 60, 60})
+	assert.Equal(t, err, nil)
+	fc1.BDel([]byte("absent"))
+	fc2.BDel([]byte("absent"))
+	_, ttl, err := chain.BGetWithTTL([]byte("absent"))
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+	assert.Equal(t, ttl, 60)
+	_, err = chain.BGet([]byte("absent"))
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+
+	assert.Equal(t, chain.GetHits(), uint64(0))
+	assert.Equal(t, chain.GetMisses(), uint64(0))
+	assert.Equal(t, chain.GetNegativeHits(), uint64(2))
+	assert.Equal(t, chain.GetNegativeBackfills(), uint64(2))
+	assert.Equal(t, fc3.GetHits(), uint64(1))
+
+	// batch lookups return tombstones flagged
+	fc1.Set("present", []byte("value"), 60)
+	chain.SetNegative("gone", []int{60, 60, 60})
+	found, misses, err := chain.MGet([]string{"present", "gone", "unknown"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), 2)
+	assert.Equal(t, found[0].Value, []byte("value"))
+	assert.Equal(t, found[0].Negative, false)
+	assert.Equal(t, found[1].Key, "gone")
+	assert.Equal(t, found[1].Value, []byte(nil))
+	assert.Equal(t, found[1].Negative, true)
+	assert.Equal(t, misses, []string{"unknown"})
+
+	// a tombstone of a nested chain is backfilled as a tombstone
+	inner, _ := chaincache.NewChainCache(fc2, fc3)
+	outerLocal, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	outer, _ := chaincache.NewChainCache(outerLocal, chaincache.NewChainCacher(inner, nil))
+	found, _, err = outer.MGet([]string{"gone"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(found), 1)
+	assert.Equal(t, found[0].Negative, true)
+	_, err = outer.Get("gone")
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+	assert.Equal(t, outerLocal.GetHits(), uint64(1))
+
+	// decorators over a nested chain agree on tombstones in Get and MGet
+	hashing, _ := chaincache.NewKeyHashingCacher(chaincache.NewChainCacher(inner, nil), chaincache.KEY_HASH_XXHASH, 64)
+	encrypting, _ := chaincache.NewEncryptingCacher(chaincache.NewChainCacher(inner, nil),
+		chaincache.EncryptionKey{ID: 1, Key: make([]byte, 32)})
+	for _, decorated := range []chaincache.Cacher{hashing, encrypting} {
+		decorated.Set("hidden", []byte("value"), 60)
+		assert.Equal(t, inner.SetNegative("hidden", []int{60, 60}), nil)
+		_, err = decorated.Get("hidden")
+		assert.Equal(t, err, chaincache.ErrNegativeHit)
+		found, misses, err = decorated.MGet([]string{"hidden"})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(misses), 0)
+		assert.Equal(t, len(found), 1)
+		assert.Equal(t, found[0].Negative, true)
+	}
+
+	// loaders report not existing keys by ErrNegativeHit
+	loads := 0
+	loader := func() ([]byte, []int, error) {
+		loads++
+		return nil, []int{60, 60, 60}, chaincache.ErrNegativeHit
+	}
+	_, err = chain.GetOrLoad("notinorigin", loader)
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+	_, err = chain.GetOrLoad("notinorigin", loader)
+	assert.Equal(t, err, chaincache.ErrNegativeHit)
+	assert.Equal(t, loads, 1)
+}
+
+func TestChainCacheRevalidation(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+
+	var loads int32
+	chain.Revalidation = &chaincache.Revalidation{
+		SoftTTL: 2,
+		Loader: func(key string) ([]byte, []int, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(50 * time.Millisecond)
+			return []byte("fresh " + key), []int{60, 60}, nil
+		},
+	}
+
+	err := chain.Set("key", []byte("old"), []int{60, 60})
+	assert.Equal(t, err, nil)
+	val, err := chain.Get("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("old"))
+	assert.Equal(t, atomic.LoadInt32(&loads), int32(0))
+
+	// after soft expiration the stale value is served while the only refresh runs
+	time.Sleep(3 * time.Second)
+	for i := 0; i < 10; i++ {
+		val, err = chain.Get("key")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, val, []byte("old"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt32(&loads), int32(1))
+	assert.Equal(t, chain.GetStaleHits(), uint64(10))
+	assert.Equal(t, chain.GetRefreshes(), uint64(1))
+
+	val, err = chain.Get("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("fresh key"))
+
+	// refresh ahead of the hard expiration
+	chain.Revalidation.SoftTTL = 0
+	chain.Revalidation.RefreshAhead = 30
+	fc2.Set("ahead", []byte("old"), 20)
+	val, err = chain.Get("ahead")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("old"))
+	time.Sleep(200 * time.Millisecond)
+	// the rest of TTL is counted in whole seconds, the sleep may cross a second boundary
+	_, ttl, _ := fc2.GetWithTTL("ahead")
+	assert.Equal(t, ttl >= 59 && ttl <= 60, true)
+	assert.Equal(t, atomic.LoadInt32(&loads), int32(2))
+}
+
+func TestChainCacheRevalidationClose(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+
+	var stored int32
+	chain.Revalidation = &chaincache.Revalidation{
+		RefreshAhead: 30,
+		Loader: func(key string) ([]byte, []int, error) {
+			time.Sleep(50 * time.Millisecond)
+			atomic.StoreInt32(&stored, 1)
+			return []byte("fresh"), []int{60, 60}, nil
+		},
+	}
+	chain.Set("key", []byte("old"), []int{10, 10})
+	checkChainHit(t, chain, "key", []byte("old"))
+	// Close waits for the running refresh instead of closing cachers under it
+	chain.Close()
+	assert.Equal(t, atomic.LoadInt32(&stored), int32(1))
+}
+
+// slowGetCacher holds lookups until gate is closed, entered signals that a lookup is started
+type slowGetCacher struct {
+	*chaincache.Freecacher
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func (c *slowGetCacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	val, ttl, err := c.Freecacher.GetWithTTLCtx(ctx, key)
+	c.entered <- struct{}{}
+	<-c.gate
+	return val, ttl, err
+}
+
+func TestChainCacheRevalidationAfterClose(t *testing.T) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	slow := &slowGetCacher{Freecacher: fc, gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	chain, _ := chaincache.NewChainCache(slow)
+
+	var loads int32
+	chain.Revalidation = &chaincache.Revalidation{
+		RefreshAhead: 30,
+		Loader: func(key string) ([]byte, []int, error) {
+			atomic.AddInt32(&loads, 1)
+			return []byte("fresh"), []int{60}, nil
+		},
+	}
+	fc.Set("key", []byte("old"), 10)
+
+	// a lookup started before Close does not start a refresh once Close has begun
+	done := make(chan struct{})
+	go func() {
+		chain.Get("key")
+		close(done)
+	}()
+	<-slow.entered
+	chain.Close()
+	close(slow.gate)
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt32(&loads), int32(0))
+	assert.Equal(t, chain.GetRefreshes(), uint64(0))
+}
+
+func TestChainCacheXFetch(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+
+	countRefreshes := func(key string) int {
+		n := 0
+		for i := 0; i < 100; i++ {
+			val, refresh, err := chain.GetXFetch(key)
+			assert.Equal(t, err, nil)
+			assert.Equal(t, len(val) > 0, true)
+			if refresh {
+				n++
+			}
+		}
+		return n
+	}
+
+	// no recorded cost means no early refreshes
+	chain.Set("plain", []byte("value"), []int{60, 60})
+	assert.Equal(t, countRefreshes("plain"), 0)
+
+	// expensive values close to expiration are refreshed early almost always
+	chain.SetWithCost("expensive", []byte("value"), time.Hour, []int{60, 60})
+	assert.Equal(t, countRefreshes("expensive") > 80, true)
+
+	// cheap ones far from expiration never are
+	chain.SetWithCost("cheap", []byte("value"), time.Millisecond, []int{60, 60})
+	assert.Equal(t, countRefreshes("cheap"), 0)
+
+	// GetOrLoad records the loader time
+	chain.XFetch = &chaincache.XFetch{Beta: 1000}
+	chain.GetOrLoad("loaded", func() ([]byte, []int, error) {
+		time.Sleep(100 * time.Millisecond)
+		return []byte("value"), []int{1, 1}, nil
+	})
+	assert.Equal(t, countRefreshes("loaded") > 80, true)
+	assert.Equal(t, countRefreshes("plain"), 0)
+
+	chain.XFetch.DefaultCost = time.Hour
+	assert.Equal(t, countRefreshes("plain") > 0, true)
+	assert.Equal(t, chain.GetEarlyRefreshes() > uint64(160), true)
+}
+
+func TestChainCacheStats(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc3, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2, fc3)
+	chain.IgnoreErrors = true
+	// closed cacher fails every operation
+	fc2.Close()
+
+	fc3.Set("key", []byte("value"), 60)
+	chain.Get("key")
+	chain.Get("key")
+	chain.Get("missed")
+	fc3.Set("batch", []byte("value"), 60)
+	chain.MGet([]string{"batch", "missed"})
+
+	stats := chain.Stats()
+	assert.Equal(t, stats.Hits, uint64(3))
+	assert.Equal(t, stats.Misses, uint64(2))
+	assert.Equal(t, len(stats.Levels), 3)
+
+	assert.Equal(t, stats.Levels[0].Hits, uint64(1))
+	assert.Equal(t, stats.Levels[0].Misses, uint64(4))
+	assert.Equal(t, stats.Levels[0].Backfills, uint64(2))
+	assert.Equal(t, stats.Levels[0].Requests, uint64(4))
+
+	assert.Equal(t, stats.Levels[1].Errors, uint64(3))
+	assert.Equal(t, stats.Levels[1].BackfillErrors, uint64(2))
+	assert.Equal(t, stats.Levels[1].Hits, uint64(0))
+
+	assert.Equal(t, stats.Levels[2].Hits, uint64(2))
+	assert.Equal(t, stats.Levels[2].Misses, uint64(2))
+	assert.Equal(t, stats.Levels[2].Requests, uint64(3))
+	assert.Equal(t, stats.Levels[2].Latency.Total > 0, true)
+	assert.Equal(t, stats.Levels[2].AvgLatency() > 0, true)
+
+	chain.Reset()
+	stats = chain.Stats()
+	assert.Equal(t, stats.Hits, uint64(0))
+	assert.Equal(t, stats.Levels[1].Errors, uint64(0))
+}
 
-		assert.Equal(t, chain.GetHits(), uint32(4))
-		assert.Equal(t, chain.GetMisses(), uint32(1))
+func TestCacherStats(t *testing.T) {
+	fc, _ := chaincache.NewFastCacher(1024*1024*32, true, false)
+	const workers, N = 8, 1000
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < N; i++ {
+				key := fmt.Sprintf("key%d_%d", w, i)
+				fc.Set(key, []byte("value"), 60)
+				fc.Get(key)
+				fc.Del(key)
+				fc.Get(key)
+			}
+		}(w)
 	}
+	wg.Wait()
+
+	stats := fc.Stats()
+	assert.Equal(t, stats.Hits, uint64(workers*N))
+	assert.Equal(t, stats.Misses, uint64(workers*N))
+	assert.Equal(t, fc.GetHits(), stats.Hits)
+	assert.Equal(t, stats.Get.Count, uint64(2*workers*N))
+	assert.Equal(t, stats.Set.Count, uint64(workers*N))
+	assert.Equal(t, stats.Del.Count, uint64(workers*N))
+	assert.Equal(t, stats.Get.Errors, uint64(0))
+	assert.Equal(t, stats.Get.Latency.P50 > 0, true)
+	assert.Equal(t, stats.Get.Latency.P50 <= stats.Get.Latency.P95, true)
+	assert.Equal(t, stats.Get.Latency.P95 <= stats.Get.Latency.P99, true)
+	assert.Equal(t, stats.Get.AvgLatency() > 0, true)
+
+	fc.Reset()
+	stats = fc.Stats()
+	assert.Equal(t, stats.Hits, uint64(0))
+	assert.Equal(t, stats.Get.Count, uint64(0))
+	assert.Equal(t, stats.Get.Latency, chaincache.Latency{})
 }
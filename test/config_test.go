@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+const testChainConfig = `{
+	"ignore_errors": true,
+	"levels": [
+		{"type": "fastcache", "ttl": 60, "fastcache": {"max_size": 33554432, "use_ttl": true},
+			"backfill": {"mode": "cap", "ttl": 30}},
+		{"type": "probecache", "ttl": 120, "probecache": {"shards": 4, "max_size": 1048576, "max_crit_size": 2097152, "max_depth": 4, "strategy": "lfu"}},
+		{"type": "%s", "ttl": 600, "params": {"size": 10485760},
+			"compression": {"algo": "zstd", "min_size": 16},
+			"namespace": {"name": "users", "generation_ttl": 3600}}
+	]
+}`
+
+// the registry of cacher types is global and keeps registrations, so every run of the test
+// registers its own type
+var configRuns int32
+
+func TestNewChainCacheFromConfig(t *testing.T) {
+	memory := fmt.Sprintf("memory%d", atomic.AddInt32(&configRuns, 1))
+	var shared chaincache.Cacher
+	err := chaincache.RegisterCacherFactory(memory, func(cfg *chaincache.LevelConfig) (chaincache.Cacher, error) {
+		size, ok := cfg.Params["size"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("size is missing")
+		}
+		fc, err := chaincache.NewFreeCacher(int(size))
+		shared = fc
+		return fc, err
+	})
+	assert.Equal(t, err, nil)
+	err = chaincache.RegisterCacherFactory(memory, nil)
+	assert.Equal(t, err != nil, true)
+
+	var cfg chaincache.ChainConfig
+	assert.Equal(t, json.Unmarshal([]byte(fmt.Sprintf(testChainConfig, memory)), &cfg), nil)
+	chain, err := chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err, nil)
+	defer chain.Close()
+	assert.Equal(t, chain.IgnoreErrors, true)
+	assert.Equal(t, chain.NoBackwardCache, false)
+	assert.Equal(t, cfg.LevelTTLs(), []int{60, 120, 600})
+	assert.Equal(t, chain.Backfill[0], chaincache.BackfillPolicy{Mode: chaincache.BACKFILL_CAP, TTL: 30})
+	assert.Equal(t, chain.Backfill[1], chaincache.BackfillPolicy{})
+
+	value := bytes.Repeat([]byte("value "), 100)
+	assert.Equal(t, chain.Set("key", value, cfg.LevelTTLs()), nil)
+	checkChainHit(t, chain, "key", value)
+	// TTLs of the levels are the defaults of SetTTL
+	assert.Equal(t, chain.SetTTL("defaults", value, 0), nil)
+	_, ttl, err := chain.GetWithTTL("defaults")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, 60)
+	// the last level is namespaced and compressed
+	checkMiss(t, shared, "key")
+	raw, err := shared.Get("users:0:key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(raw) < len(value), true)
+	// the namespace of the level is reachable to be bumped
+	namespaced, ok := chain.Level(2).(*chaincache.NamespacedCacher)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, namespaced.Bump(), nil)
+	chain.Level(0).Del("key")
+	chain.Level(1).Del("key")
+	checkChainMiss(t, chain, "key")
+	assert.Equal(t, chain.Level(3), nil)
+
+	cfg.WriteBehind = &chaincache.WriteBehindCfg{LocalLevels: 2, Backpressure: "sometimes"}
+	_, err = chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err.Error(), `write-behind: unknown backpressure policy "sometimes"`)
+	cfg.WriteBehind.Backpressure = "oldest"
+	behind, err := chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, behind.Set("key", value, cfg.LevelTTLs()), nil)
+	behind.FlushWriteBehind()
+	_, err = shared.Get("users:0:key")
+	assert.Equal(t, err, nil)
+	behind.Close()
+	cfg.WriteBehind = nil
+
+	cfg.Levels[0].Backfill.Mode = "sometimes"
+	_, err = chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err.Error(), `level 0 (fastcache): unknown backfill mode "sometimes"`)
+	cfg.Levels[0].Backfill = nil
+
+	cfg.Levels[1].Type = "unknown"
+	_, err = chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err.Error(), `level 1 (unknown): unknown cacher type "unknown"`)
+
+	cfg.Levels[1] = chaincache.LevelConfig{Type: "freecache"}
+	_, err = chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err.Error(), "level 1 (freecache): freecache settings are missing")
+}
+
+func TestNewChainCacheFromPartialConfig(t *testing.T) {
+	cfg := chaincache.ChainConfig{
+		Levels: []chaincache.LevelConfig{
+			{Type: "freecache", TTL: 60, Freecache: &chaincache.FreecacheCfg{MaxSize: 1024 * 1024}},
+			{Type: "freecache", Freecache: &chaincache.FreecacheCfg{MaxSize: 1024 * 1024}},
+		},
+	}
+	chain, err := chaincache.NewChainCacheFromConfig(&cfg)
+	assert.Equal(t, err, nil)
+	defer chain.Close()
+
+	// the level without a TTL gets the passed one instead of an endless one
+	assert.Equal(t, chain.SetTTL("key", []byte("value"), 30), nil)
+	_, ttl, err := chain.Level(0).GetWithTTL("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, 60)
+	_, ttl, err = chain.Level(1).GetWithTTL("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, 30)
+}
@@ -0,0 +1,316 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+func TestCompressingCacher(t *testing.T) {
+	algos := []chaincache.CompressionAlgo{
+		chaincache.COMPRESS_SNAPPY,
+		chaincache.COMPRESS_ZSTD,
+		chaincache.COMPRESS_GZIP,
+	}
+	for _, algo := range algos {
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			cc, err := chaincache.NewCompressingCacher(fc, algo, 16)
+			assert.Equal(t, err, nil)
+			testCacher(t, cc, false)
+		}
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			cc, _ := chaincache.NewCompressingCacher(fc, algo, 16)
+			testCacherBytes(t, cc)
+		}
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			cc, _ := chaincache.NewCompressingCacher(fc, algo, 16)
+			testCacherBatch(t, cc)
+		}
+
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		cc, _ := chaincache.NewCompressingCacher(fc, algo, 16)
+
+		// big values are stored compressed
+		big := bytes.Repeat([]byte(`{"field":"value"},`), 300)
+		cc.Set("big", big, 60)
+		raw, _ := fc.Get("big")
+		assert.Equal(t, len(raw) < len(big)/4, true)
+		checkHit(t, cc, "big", big)
+
+		// small ones and values written before compression as is
+		cc.Set("small", []byte("small"), 60)
+		checkHit(t, fc, "small", []byte("small"))
+		fc.Set("legacy", big, 60)
+		checkHit(t, cc, "legacy", big)
+
+		// raw values looking like compressed ones survive
+		tricky := []byte{0xCC, 0x5A, 0x02, 0x01}
+		cc.Set("tricky", tricky, 60)
+		checkHit(t, cc, "tricky", tricky)
+	}
+
+	_, err := chaincache.NewCompressingCacher(nil, chaincache.CompressionAlgo(100), 0)
+	assert.Equal(t, err != nil, true)
+}
+
+func TestChainCacheCompressedLevel(t *testing.T) {
+	local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	compressed, _ := chaincache.NewCompressingCacher(remote, chaincache.COMPRESS_ZSTD, 128)
+	chain, _ := chaincache.NewChainCache(local, compressed)
+
+	big := bytes.Repeat([]byte("payload "), 1000)
+	chain.Set("key", big, []int{60, 60})
+	checkHit(t, local, "key", big)
+	raw, _ := remote.Get("key")
+	assert.Equal(t, len(raw) < len(big), true)
+
+	local.Del("key")
+	val, err := chain.Get("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, big)
+	checkHit(t, local, "key", big)
+}
+
+func TestEncryptingCacher(t *testing.T) {
+	key1 := chaincache.EncryptionKey{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}
+	key2 := chaincache.EncryptionKey{ID: 2, Key: bytes.Repeat([]byte{2}, 16)}
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		ec, err := chaincache.NewEncryptingCacher(fc, key1)
+		assert.Equal(t, err, nil)
+		testCacher(t, ec, false)
+	}
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		ec, _ := chaincache.NewEncryptingCacher(fc, key1)
+		ec.HashKeys([]byte("secret"))
+		testCacherBytes(t, ec)
+	}
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		ec, _ := chaincache.NewEncryptingCacher(fc, key1)
+		ec.HashKeys([]byte("secret"))
+		testCacherBatch(t, ec)
+	}
+
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	ec1, _ := chaincache.NewEncryptingCacher(fc, key1)
+	value := []byte("user data")
+	ec1.Set("user:42", value, 60)
+	raw, _ := fc.Get("user:42")
+	assert.Equal(t, bytes.Contains(raw, value), false)
+
+	// rotated key still reads old values and writes with the new one
+	ec2, _ := chaincache.NewEncryptingCacher(fc, key2, key1)
+	checkHit(t, ec2, "user:42", value)
+	ec2.Set("user:43", value, 60)
+	// values of unknown keys are misses
+	checkMiss(t, ec1, "user:43")
+	_, err := ec1.Get("user:43")
+	assert.Equal(t, err, chaincache.ErrMiss)
+
+	// values are bound to their keys
+	fc.Set("user:44", raw, 60)
+	_, err = ec1.Get("user:44")
+	assert.Equal(t, err, chaincache.ErrDecrypt)
+
+	// plain values are not accepted
+	fc.Set("plain", value, 60)
+	checkMiss(t, ec1, "plain")
+
+	// a chain falls through a value of a dropped key and overwrites it
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	remote.Set("user:43", value, 60)
+	chain, _ := chaincache.NewChainCache(ec1, remote)
+	checkChainHit(t, chain, "user:43", value)
+	checkHit(t, ec1, "user:43", value)
+
+	// hashed keys never reach the storage
+	hashed, _ := chaincache.NewEncryptingCacher(fc, key1)
+	hashed.HashKeys([]byte("secret"))
+	hashed.Set("user:45", value, 60)
+	checkMiss(t, fc, "user:45")
+	checkHit(t, hashed, "user:45", value)
+	checkBHit(t, hashed, []byte("user:45"), value)
+
+	_, err = chaincache.NewEncryptingCacher(fc, chaincache.EncryptionKey{ID: 1, Key: []byte("short")})
+	assert.Equal(t, err != nil, true)
+	_, err = chaincache.NewEncryptingCacher(fc, key1, key1)
+	assert.Equal(t, err != nil, true)
+}
+
+func TestNamespacedCacher(t *testing.T) {
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		nc, err := chaincache.NewNamespacedCacher(fc, "service", 0)
+		assert.Equal(t, err, nil)
+		// counters of the generation lookup are dropped
+		nc.Reset()
+		testCacher(t, nc, false)
+	}
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		nc, _ := chaincache.NewNamespacedCacher(fc, "service", 0)
+		nc.Reset()
+		testCacherBytes(t, nc)
+	}
+	{
+		fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		nc, _ := chaincache.NewNamespacedCacher(fc, "service", 0)
+		nc.Reset()
+		testCacherBatch(t, nc)
+	}
+
+	shared, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	pod1, _ := chaincache.NewNamespacedCacher(shared, "users", 0)
+	pod2, _ := chaincache.NewNamespacedCacher(shared, "users", 10*time.Millisecond)
+	defer pod2.Close()
+	other, _ := chaincache.NewNamespacedCacher(shared, "orders", 0)
+	pod1.GenerationTTL = 3600
+	pod2.GenerationTTL = 3600
+
+	pod1.Set("key", []byte("user"), 60)
+	other.Set("key", []byte("order"), 60)
+	checkHit(t, pod2, "key", []byte("user"))
+	checkHit(t, other, "key", []byte("order"))
+	checkHit(t, shared, "users:0:key", []byte("user"))
+	checkBHit(t, pod2, []byte("key"), []byte("user"))
+
+	assert.Equal(t, pod1.Bump(), nil)
+	assert.Equal(t, pod1.Generation(), uint64(1))
+	checkMiss(t, pod1, "key")
+	checkHit(t, other, "key", []byte("order"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, pod2.Generation(), uint64(1))
+	checkMiss(t, pod2, "key")
+
+	// the lost generation is restored, not reset to zero
+	shared.Del("users" + chaincache.NAMESPACE_GENERATION_SUFFIX)
+	assert.Equal(t, pod1.Refresh(), nil)
+	pod3, _ := chaincache.NewNamespacedCacher(shared, "users", 0)
+	assert.Equal(t, pod3.Generation(), uint64(1))
+}
+
+func TestNamespacedChain(t *testing.T) {
+	shared, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	newInstance := func() *chaincache.NamespacedCacher {
+		local, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+		chain, _ := chaincache.NewChainCache(local, shared)
+		nc, err := chaincache.NewNamespacedCacher(chaincache.NewChainCacher(chain, nil), "users", 0)
+		assert.Equal(t, err, nil)
+		return nc
+	}
+	pod1 := newInstance()
+	pod2 := newInstance()
+
+	pod1.Set("key", []byte("v1"), 60)
+	checkHit(t, pod2, "key", []byte("v1"))
+	assert.Equal(t, pod1.Bump(), nil)
+	assert.Equal(t, pod1.Bump(), nil)
+	assert.Equal(t, pod1.Generation(), uint64(2))
+
+	// the generation is kept only in the shared level with the default TTL
+	_, ttl, err := shared.GetWithTTL("users" + chaincache.NAMESPACE_GENERATION_SUFFIX)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl > 0, true)
+	assert.Equal(t, pod2.Refresh(), nil)
+	assert.Equal(t, pod2.Generation(), uint64(2))
+	checkMiss(t, pod2, "key")
+	pod3 := newInstance()
+	assert.Equal(t, pod3.Generation(), uint64(2))
+}
+
+func TestNamespacedCacherGenerationRace(t *testing.T) {
+	shared, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	// writes of pod1 to the shared level wait for the gate
+	gated := &gatedCacher{Freecacher: shared, gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	pod1, _ := chaincache.NewNamespacedCacher(gated, "users", 0)
+	pod2, _ := chaincache.NewNamespacedCacher(shared, "users", 0)
+	assert.Equal(t, pod2.Bump(), nil)
+	assert.Equal(t, pod1.Refresh(), nil)
+	assert.Equal(t, pod1.Generation(), uint64(1))
+
+	// pod1 bumps to 2 slowly, meanwhile pod2 bumps to 3 and pod1 refreshes to it
+	bumped := make(chan error)
+	go func() {
+		bumped <- pod1.Bump()
+	}()
+	<-gated.entered
+	assert.Equal(t, pod2.Bump(), nil)
+	assert.Equal(t, pod2.Bump(), nil)
+	assert.Equal(t, pod1.Refresh(), nil)
+	assert.Equal(t, pod1.Generation(), uint64(3))
+
+	// the finished bump does not take pod1 back
+	close(gated.gate)
+	assert.Equal(t, <-bumped, nil)
+	assert.Equal(t, pod1.Generation(), uint64(3))
+	assert.Equal(t, pod1.Refresh(), nil)
+	assert.Equal(t, pod2.Refresh(), nil)
+	assert.Equal(t, pod2.Generation(), uint64(3))
+}
+
+func TestKeyHashingCacher(t *testing.T) {
+	for _, algo := range []chaincache.KeyHashAlgo{chaincache.KEY_HASH_XXHASH, chaincache.KEY_HASH_SHA256} {
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			kc, err := chaincache.NewKeyHashingCacher(fc, algo, 0)
+			assert.Equal(t, err, nil)
+			testCacher(t, kc, false)
+		}
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			kc, _ := chaincache.NewKeyHashingCacher(fc, algo, 0)
+			testCacherBytes(t, kc)
+		}
+		{
+			fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+			kc, _ := chaincache.NewKeyHashingCacher(fc, algo, 0)
+			testCacherBatch(t, kc)
+		}
+	}
+
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	kc, _ := chaincache.NewKeyHashingCacher(fc, chaincache.KEY_HASH_XXHASH, 16)
+	long := "https://example.com/" + string(bytes.Repeat([]byte("path/"), 1000))
+	kc.Set("short", []byte("raw"), 60)
+	kc.Set(long, []byte("hashed"), 60)
+	checkHit(t, fc, "short", []byte("raw"))
+	checkMiss(t, fc, long)
+	checkHit(t, kc, long, []byte("hashed"))
+	checkBHit(t, kc, []byte(long), []byte("hashed"))
+	// short keys looking like hashed ones are hashed too
+	kc.Set(chaincache.HASHED_KEY_PREFIX+"1", []byte("value"), 60)
+	checkMiss(t, fc, chaincache.HASHED_KEY_PREFIX+"1")
+	checkHit(t, kc, chaincache.HASHED_KEY_PREFIX+"1", []byte("value"))
+
+	// a value of another key under the same hash is a miss
+	hashed := func(key string) string {
+		return fmt.Sprintf("%s%016x", chaincache.HASHED_KEY_PREFIX, xxhash.Sum64String(key))
+	}
+	other := long + "/other"
+	raw, err := fc.Get(hashed(long))
+	assert.Equal(t, err, nil)
+	fc.Set(hashed(other), raw, 60)
+	checkMiss(t, kc, other)
+	items, misses, err := kc.MGet([]string{long, other})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(items), 1)
+	assert.Equal(t, misses, []string{other})
+
+	// the guard miss is observed as a miss, not as a hit of the found value
+	observer := &recordingObserver{}
+	oc := chaincache.NewObservedCacher(kc, observer)
+	checkMiss(t, oc, other)
+	checkHit(t, oc, long, []byte("hashed"))
+	assert.Equal(t, observer.take(), []string{"miss " + other, "hit 0 " + long})
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+// newPod returns a chain of a local level over the shared remote level subscribed to bus
+func newPod(t *testing.T, remote chaincache.Cacher, bus chaincache.InvalidationBus) (*chaincache.ChainCache, *chaincache.Fastcacher) {
+	local, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	chain, _ := chaincache.NewChainCache(local, remote)
+	err := chain.SubscribeInvalidation(bus, 1)
+	assert.Equal(t, err, nil)
+	return chain, local
+}
+
+func checkChainHit(t *testing.T, c *chaincache.ChainCache, key string, value []byte) {
+	val, err := c.Get(key)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, value)
+}
+
+func checkChainMiss(t *testing.T, c *chaincache.ChainCache, key string) {
+	_, err := c.Get(key)
+	assert.Equal(t, err, chaincache.ErrMiss)
+}
+
+func testInvalidation(t *testing.T, bus chaincache.InvalidationBus, wait func()) {
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	pod1, local1 := newPod(t, remote, bus)
+	pod2, local2 := newPod(t, remote, bus)
+	ttls := []int{60, 60}
+
+	pod1.Set("key", []byte("v1"), ttls)
+	checkChainHit(t, pod2, "key", []byte("v1"))
+	checkHit(t, local2, "key", []byte("v1"))
+
+	// the publisher keeps its own fresh value
+	pod1.Set("key", []byte("v2"), ttls)
+	wait()
+	checkHit(t, local1, "key", []byte("v2"))
+	checkMiss(t, local2, "key")
+	checkChainHit(t, pod2, "key", []byte("v2"))
+
+	pod1.Del("key")
+	wait()
+	checkMiss(t, local2, "key")
+	checkChainMiss(t, pod2, "key")
+
+	pod2.MSet([]chaincache.Item{{Key: "a", Value: []byte("a")}, {Key: "b", Value: []byte("b")}}, ttls)
+	pod1.MGet([]string{"a", "b"})
+	checkHit(t, local1, "a", []byte("a"))
+	pod2.MDel([]string{"a", "b"})
+	wait()
+	checkMiss(t, local1, "a")
+	checkMiss(t, local1, "b")
+	checkChainMiss(t, pod1, "a")
+
+	assert.Equal(t, pod1.Stats().Invalidations, uint64(4))
+	assert.Equal(t, pod2.Stats().Invalidations, uint64(3))
+
+	// closed chain does not listen anymore
+	pod2.Close()
+	pod1.Set("key", []byte("v3"), ttls)
+	wait()
+	assert.Equal(t, pod2.Stats().Invalidations, uint64(3))
+}
+
+func TestLocalInvalidationBus(t *testing.T) {
+	testInvalidation(t, chaincache.NewLocalInvalidationBus(), func() {})
+
+	bus := chaincache.NewLocalInvalidationBus()
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	pod, _ := newPod(t, remote, bus)
+	assert.Equal(t, pod.SubscribeInvalidation(bus, 1) != nil, true)
+}
+
+func TestRedisInvalidationBus(t *testing.T) {
+	cfg := chaincache.RediscacherCfg{
+		Host:        REDIS_TEST_HOSTS[0],
+		ClusterMode: false,
+	}
+	rc, err := chaincache.NewRediscacher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	bus, err := rc.InvalidationBus("chaincache-test-invalidation")
+	assert.Equal(t, err, nil)
+	// messages are delivered asynchronously
+	testInvalidation(t, bus, func() { time.Sleep(100 * time.Millisecond) })
+}
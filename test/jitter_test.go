@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+func TestCacherJitter(t *testing.T) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc.Jitter = &chaincache.Jitter{Percent: 10}
+	other, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	other.Jitter = &chaincache.Jitter{Percent: 10}
+
+	ttls := make(map[int]bool)
+	for ix := 0; ix < 50; ix++ {
+		key := fmt.Sprintf("key%d", ix)
+		assert.Equal(t, fc.Set(key, []byte("value"), 1000), nil)
+		_, ttl, err := fc.GetWithTTL(key)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ttl >= 899 && ttl <= 1100, true)
+		ttls[ttl] = true
+
+		// the shift depends only on the key
+		assert.Equal(t, other.BSet([]byte(key), []byte("value"), 1000), nil)
+		_, otherTTL, _ := other.GetWithTTL(key)
+		assert.Equal(t, otherTTL-ttl <= 1 && ttl-otherTTL <= 1, true)
+	}
+	assert.Equal(t, len(ttls) > 10, true)
+
+	fast, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	fast.Jitter = &chaincache.Jitter{Window: 30}
+	for ix := 0; ix < 50; ix++ {
+		key := []byte(fmt.Sprintf("key%d", ix))
+		assert.Equal(t, fast.BSet(key, []byte("value"), 100), nil)
+		_, ttl, err := fast.BGetWithTTL(key)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ttl >= 69 && ttl <= 130, true)
+	}
+}
+
+func TestChainCacheJitter(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	jitter := &chaincache.Jitter{Percent: 20}
+	chain.Jitter = jitter
+
+	// a plain cacher with the same jitter shows the expected shift
+	expected, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	expected.Jitter = jitter
+	expectedTTL := func(key string, ttl int) int {
+		expected.Set(key, []byte("value"), ttl)
+		_, ttl, _ = expected.GetWithTTL(key)
+		return ttl
+	}
+	near := func(a, b int) bool {
+		return a-b <= 1 && b-a <= 1
+	}
+
+	for ix := 0; ix < 20; ix++ {
+		key := fmt.Sprintf("key%d", ix)
+		assert.Equal(t, chain.Set(key, []byte("value"), []int{100, 1000}), nil)
+		_, ttl1, _ := fc1.GetWithTTL(key)
+		_, ttl2, _ := fc2.GetWithTTL(key)
+		assert.Equal(t, near(ttl1, expectedTTL(key, 100)), true)
+		assert.Equal(t, near(ttl2, expectedTTL(key, 1000)), true)
+	}
+
+	// the rest of TTL has been shifted when the deep level was written, backfilled copies keep it
+	for ix := 0; ix < 20; ix++ {
+		key := fmt.Sprintf("deep%d", ix)
+		chain.Set(key, []byte("value"), []int{100, 1000})
+		fc1.Del(key)
+		checkChainHit(t, chain, key, []byte("value"))
+		_, ttl1, err := fc1.GetWithTTL(key)
+		assert.Equal(t, err, nil)
+		_, ttl2, _ := fc2.GetWithTTL(key)
+		assert.Equal(t, ttl1 <= ttl2, true)
+		assert.Equal(t, near(ttl1, expectedTTL(key, 1000)), true)
+	}
+
+	keys := []string{"batch0", "batch1", "batch2"}
+	chain.MSet([]chaincache.Item{{Key: keys[0]}, {Key: keys[1]}, {Key: keys[2]}}, []int{100, 1000})
+	fc1.MDel(keys)
+	_, misses, err := chain.MGet(keys)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(misses), 0)
+	for _, key := range keys {
+		_, ttl1, _ := fc1.GetWithTTL(key)
+		_, ttl2, _ := fc2.GetWithTTL(key)
+		assert.Equal(t, ttl1 <= ttl2, true)
+		assert.Equal(t, near(ttl1, expectedTTL(key, 1000)), true)
+	}
+
+	// TTLs of a backfill policy are shifted, a capped one still does not outlive the found value
+	chain.Backfill = []chaincache.BackfillPolicy{{Mode: chaincache.BACKFILL_CAP, TTL: 900}}
+	for ix := 0; ix < 20; ix++ {
+		key := fmt.Sprintf("capped%d", ix)
+		chain.Set(key, []byte("value"), []int{100, 1000})
+		fc1.Del(key)
+		checkChainHit(t, chain, key, []byte("value"))
+		_, ttl1, _ := fc1.GetWithTTL(key)
+		_, ttl2, _ := fc2.GetWithTTL(key)
+		assert.Equal(t, ttl1 <= ttl2, true)
+		assert.Equal(t, near(ttl1, expectedTTL(key, 900)) || near(ttl1, ttl2), true)
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	o.events = append(o.events, event)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) take() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func (o *recordingObserver) OnHit(level int, key string) {
+	o.record(fmt.Sprintf("hit %d %s", level, key))
+}
+
+func (o *recordingObserver) OnMiss(key string) {
+	o.record("miss " + key)
+}
+
+func (o *recordingObserver) OnBackfill(level int, key string) {
+	o.record(fmt.Sprintf("backfill %d %s", level, key))
+}
+
+func (o *recordingObserver) OnError(level int, op string, err error) {
+	o.record(fmt.Sprintf("error %d %s %v", level, op, err))
+}
+
+func (o *recordingObserver) OnSet(key string) {
+	o.record("set " + key)
+}
+
+func (o *recordingObserver) OnDel(key string) {
+	o.record("del " + key)
+}
+
+func TestChainCacheObserver(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc3, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2, fc3)
+	observer := &recordingObserver{}
+	chain.Observer = observer
+	chain.IgnoreErrors = true
+	// closed cacher fails every operation
+	fc2.Close()
+
+	fc3.Set("key", []byte("value"), 60)
+	chain.Get("key")
+	assert.Equal(t, observer.take(), []string{
+		"error 1 get " + chaincache.ErrNotInited.Error(),
+		"hit 2 key",
+		"error 1 backfill " + chaincache.ErrNotInited.Error(),
+		"backfill 0 key",
+	})
+
+	chain.BGet([]byte("missed"))
+	assert.Equal(t, observer.take()[1:], []string{"miss missed"})
+
+	chain.Set("key", []byte("value"), []int{60, 60, 60})
+	chain.Del("key")
+	assert.Equal(t, observer.take(), []string{
+		"error 1 set " + chaincache.ErrNotInited.Error(),
+		"set key",
+		"error 1 del " + chaincache.ErrNotInited.Error(),
+		"del key",
+	})
+
+	fc3.Set("batch", []byte("value"), 60)
+	chain.MGet([]string{"batch", "missed"})
+	assert.Equal(t, observer.take(), []string{
+		"error 1 mget " + chaincache.ErrNotInited.Error(),
+		"hit 2 batch",
+		"error 1 backfill " + chaincache.ErrNotInited.Error(),
+		"backfill 0 batch",
+		"miss missed",
+	})
+
+	chain.Observer = nil
+	chain.Get("batch")
+	assert.Equal(t, len(observer.take()), 0)
+}
+
+func TestObservedCacher(t *testing.T) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	observer := &recordingObserver{}
+	oc := chaincache.NewObservedCacher(fc, observer)
+	oc.Level = 1
+	testCacher(t, oc, false)
+	observer.take()
+
+	oc.Set("key", []byte("value"), 60)
+	oc.Get("key")
+	oc.BGet([]byte("missed"))
+	oc.Del("key")
+	oc.MSet([]chaincache.Item{{Key: "a", Value: []byte("a"), TTL: 60}})
+	oc.MGet([]string{"a", "b"})
+	assert.Equal(t, observer.take(), []string{
+		"set key",
+		"hit 1 key",
+		"miss missed",
+		"del key",
+		"set a",
+		"hit 1 a",
+		"miss b",
+	})
+
+	fc.Close()
+	oc.Get("key")
+	assert.Equal(t, observer.take(), []string{"error 1 get " + chaincache.ErrNotInited.Error()})
+}
+
+// countingObserver counts events without allocating
+type countingObserver struct {
+	chaincache.NopObserver
+	hits int64
+}
+
+func (o *countingObserver) OnHit(level int, key string) {
+	atomic.AddInt64(&o.hits, 1)
+}
+
+func TestChainCacheObserverAllocs(t *testing.T) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc)
+	chain.Set("key", []byte("value"), []int{60})
+
+	get := func() { chain.Get("key") }
+	// freecache copies the value out of its segment
+	assert.Equal(t, testing.AllocsPerRun(100, get), float64(1))
+
+	// string keys are passed to the observer as is
+	observer := &countingObserver{}
+	chain.Observer = observer
+	assert.Equal(t, testing.AllocsPerRun(100, get), float64(1))
+	assert.Equal(t, atomic.LoadInt64(&observer.hits) > 100, true)
+
+	// byte keys are converted for the observer only
+	key := []byte("key")
+	bget := func() { chain.BGet(key) }
+	chain.Observer = nil
+	assert.Equal(t, testing.AllocsPerRun(100, bget), float64(1))
+	chain.Observer = observer
+	assert.Equal(t, testing.AllocsPerRun(100, bget), float64(2))
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	collector := chaincache.NewCollector("test")
+	reg := prometheus.NewPedanticRegistry()
+	assert.Equal(t, reg.Register(collector), nil)
+
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	ic := collector.Register("free", fc)
+	testCacher(t, ic, false)
+	testCacherBatch(t, ic)
+
+	count, err := testutil.GatherAndCount(reg, "test_cacher_entries")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	assert.Equal(t, testutil.CollectAndCount(collector, "test_cacher_operation_duration_seconds") > 0, true)
+
+	collector = chaincache.NewCollector("test")
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	l1, _ := chaincache.NewFastCacher(1024*1024*32, true, false)
+	l2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, err := collector.NewChainCache("chain", l1, l2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, collector.RegisterChain("chain", chain) != nil, true)
+
+	l2.Set("key", []byte("value"), 60)
+	chain.Get("key")
+	chain.Get("key")
+	chain.Get("missed")
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP test_chain_lookups_total Chain lookups by result.
+# TYPE test_chain_lookups_total counter
+test_chain_lookups_total{chain="chain",result="hit"} 2
+test_chain_lookups_total{chain="chain",result="miss"} 1
+test_chain_lookups_total{chain="chain",result="negative_hit"} 0
+test_chain_lookups_total{chain="chain",result="stale_hit"} 0
+`), "test_chain_lookups_total")
+	assert.Equal(t, err, nil)
+
+	// the first get misses level 0 and backfills it, the second one hits it
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP test_cacher_lookups_total Keys looked up in cacher by result.
+# TYPE test_cacher_lookups_total counter
+test_cacher_lookups_total{cacher="chain",level="0",result="hit"} 1
+test_cacher_lookups_total{cacher="chain",level="0",result="miss"} 2
+test_cacher_lookups_total{cacher="chain",level="1",result="hit"} 1
+test_cacher_lookups_total{cacher="chain",level="1",result="miss"} 1
+`), "test_cacher_lookups_total")
+	assert.Equal(t, err, nil)
+
+	count, err = testutil.GatherAndCount(reg, "test_cacher_entries")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 2)
+
+	collector = chaincache.NewCollector("test")
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	_, err = collector.NewChainCache("small")
+	assert.Equal(t, err != nil, true)
+	// the name of a failed chain is free again
+	l3, _ := chaincache.NewFreeCacher(1000)
+	small, _ := chaincache.NewChainCache(l3)
+	assert.Equal(t, collector.RegisterChain("small", small), nil)
+	// freecache allocates its minimal size for smaller ones
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP test_cacher_size_bytes Memory used by local cacher.
+# TYPE test_cacher_size_bytes gauge
+test_cacher_size_bytes{cacher="small",level="0"} 524288
+`), "test_cacher_size_bytes")
+	assert.Equal(t, err, nil)
+
+	// levels of a registered chain are still reachable as they have been passed
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	ns, err := chaincache.NewNamespacedCacher(remote, "svc", 0)
+	assert.Equal(t, err, nil)
+	local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	nsChain, _ := chaincache.NewChainCache(local, ns)
+	assert.Equal(t, collector.RegisterChain("namespaced", nsChain), nil)
+	assert.Equal(t, nsChain.Level(0), chaincache.Cacher(local))
+	level, ok := nsChain.Level(1).(*chaincache.NamespacedCacher)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, level.Bump(), nil)
+	assert.Equal(t, ns.Generation(), uint64(1))
+}
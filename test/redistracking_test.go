@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+func TestRedisTracking(t *testing.T) {
+	cfg := chaincache.RediscacherCfg{
+		Host:        REDIS_TEST_HOSTS[0],
+		ClusterMode: false,
+	}
+	pods := make([]*chaincache.ChainCache, 2)
+	locals := make([]*chaincache.Fastcacher, 2)
+	for ix := range pods {
+		rc, err := chaincache.NewRediscacher(&cfg)
+		if err != nil {
+			panic(err)
+		}
+		locals[ix], _ = chaincache.NewFastCacher(1024*1024*10, true, false)
+		err = rc.EnableTracking(locals[ix], "tracking:")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, rc.EnableTracking(locals[ix]) != nil, true)
+		pods[ix], _ = chaincache.NewChainCache(locals[ix], rc)
+		defer pods[ix].Close()
+	}
+	ttls := []int{60, 60}
+	// invalidations are delivered asynchronously
+	wait := func() { time.Sleep(100 * time.Millisecond) }
+
+	pods[0].Set("tracking:key", []byte("v1"), ttls)
+	pods[0].Set("other:key", []byte("v1"), ttls)
+	wait()
+	checkChainHit(t, pods[1], "tracking:key", []byte("v1"))
+	checkChainHit(t, pods[1], "other:key", []byte("v1"))
+	checkHit(t, locals[1], "tracking:key", []byte("v1"))
+
+	pods[0].Set("tracking:key", []byte("v2"), ttls)
+	pods[0].Set("other:key", []byte("v2"), ttls)
+	wait()
+	checkMiss(t, locals[1], "tracking:key")
+	checkChainHit(t, pods[1], "tracking:key", []byte("v2"))
+	// keys out of the prefixes are not tracked
+	checkHit(t, locals[1], "other:key", []byte("v1"))
+
+	pods[0].Del("tracking:key")
+	wait()
+	checkMiss(t, locals[1], "tracking:key")
+	checkChainMiss(t, pods[1], "tracking:key")
+
+	// a flush of the database drops the whole local cache
+	pods[0].Set("tracking:key", []byte("v3"), ttls)
+	wait()
+	checkChainHit(t, pods[1], "tracking:key", []byte("v3"))
+	client := redis.NewClient(&redis.Options{Addr: REDIS_TEST_HOSTS[0]})
+	defer client.Close()
+	assert.Equal(t, client.FlushDB(context.Background()).Err(), nil)
+	wait()
+	checkMiss(t, locals[1], "tracking:key")
+	checkMiss(t, locals[1], "other:key")
+}
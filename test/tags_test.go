@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+func TestChainCacheTags(t *testing.T) {
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	local1, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	local2, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	pod1, _ := chaincache.NewChainCache(local1, remote)
+	pod2, _ := chaincache.NewChainCache(local2, remote)
+	ttls := []int{60, 60}
+
+	assert.Equal(t, pod1.SetWithTags("page1", []byte("p1"), ttls, "user:42"), nil)
+	assert.Equal(t, pod1.SetWithTags("page2", []byte("p2"), ttls, "user:42", "pages"), nil)
+	assert.Equal(t, pod1.SetWithTags("page3", []byte("p3"), ttls, "user:43", "pages"), nil)
+	checkChainHit(t, pod1, "page1", []byte("p1"))
+	// the second instance gets the entries into its local level
+	checkChainHit(t, pod2, "page1", []byte("p1"))
+	items, misses, err := pod2.MGet([]string{"page2", "page3"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, len(misses), 0)
+
+	assert.Equal(t, pod1.InvalidateTag("user:42"), nil)
+	checkChainMiss(t, pod1, "page1")
+	checkChainMiss(t, pod2, "page1")
+	checkChainMiss(t, pod2, "page2")
+	checkChainHit(t, pod2, "page3", []byte("p3"))
+	items, misses, err = pod2.MGet([]string{"page1", "page2", "page3"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(items), 1)
+	assert.Equal(t, items[0].Value, []byte("p3"))
+	assert.Equal(t, misses, []string{"page1", "page2"})
+	// both levels have the invalidated entries
+	assert.Equal(t, pod2.Stats().TagMisses, uint64(8))
+
+	// stored again the entry gets the new version
+	assert.Equal(t, pod2.SetWithTags("page1", []byte("p1"), ttls, "user:42"), nil)
+	checkChainHit(t, pod1, "page1", []byte("p1"))
+
+	assert.Equal(t, pod1.InvalidateTag("pages"), nil)
+	checkChainMiss(t, pod2, "page3")
+	checkChainHit(t, pod2, "page1", []byte("p1"))
+
+	// entries without tags are not affected
+	pod1.Set("plain", []byte("v"), ttls)
+	assert.Equal(t, pod1.InvalidateTag("user:42"), nil)
+	checkChainHit(t, pod1, "plain", []byte("v"))
+	checkChainMiss(t, pod1, "page1")
+}
+
+func TestChainCachePrefixInvalidation(t *testing.T) {
+	remote, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	local1, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	local2, _ := chaincache.NewFastCacher(1024*1024*10, true, false)
+	pod1, _ := chaincache.NewChainCache(local1, remote)
+	pod2, _ := chaincache.NewChainCache(local2, remote)
+	for _, pod := range []*chaincache.ChainCache{pod1, pod2} {
+		pod.GroupPrefixes = []string{"user:", "user:42:"}
+	}
+	ttls := []int{60, 60}
+
+	pod1.Set("user:42:profile", []byte("p"), ttls)
+	pod1.MSet([]chaincache.Item{{Key: "user:42:feed", Value: []byte("f")}, {Key: "user:43:feed", Value: []byte("f")}}, ttls)
+	assert.Equal(t, pod1.SetWithTags("user:43:page", []byte("p"), ttls, "pages"), nil)
+	pod1.SetNegative("user:42:missing", ttls)
+	pod1.Set("item:1", []byte("i"), ttls)
+	checkChainHit(t, pod2, "user:42:profile", []byte("p"))
+	checkChainHit(t, pod2, "user:43:feed", []byte("f"))
+
+	assert.Equal(t, pod2.InvalidatePrefix("user:42:"), nil)
+	checkChainMiss(t, pod1, "user:42:profile")
+	checkChainMiss(t, pod2, "user:42:profile")
+	checkChainMiss(t, pod1, "user:42:missing")
+	items, misses, err := pod1.MGet([]string{"user:42:feed", "user:43:feed", "user:43:page"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, misses, []string{"user:42:feed"})
+
+	// a wider prefix drops the narrower groups too, keys outside of groups are not affected
+	assert.Equal(t, pod1.InvalidatePrefix("user:"), nil)
+	checkChainMiss(t, pod2, "user:43:feed")
+	checkChainMiss(t, pod2, "user:43:page")
+	checkChainHit(t, pod2, "item:1", []byte("i"))
+
+	// stored again the entry gets the new versions
+	pod1.Set("user:42:profile", []byte("p2"), ttls)
+	checkChainHit(t, pod2, "user:42:profile", []byte("p2"))
+
+	assert.Equal(t, pod1.InvalidatePrefix("item:") != nil, true)
+	assert.Equal(t, pod1.SetWithTags("key", []byte("v"), ttls, "\x00user:") != nil, true)
+}
+
+func TestChainCacheTagsRefresh(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	chain.Revalidation = &chaincache.Revalidation{
+		RefreshAhead: 30,
+		Loader: func(key string) ([]byte, []int, error) {
+			return []byte("fresh"), []int{60, 60}, nil
+		},
+	}
+
+	// the refreshed entry keeps the tags of the old one
+	assert.Equal(t, chain.SetWithTags("key", []byte("old"), []int{10, 10}, "user:42"), nil)
+	checkChainHit(t, chain, "key", []byte("old"))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, chain.GetRefreshes(), uint64(1))
+	checkChainHit(t, chain, "key", []byte("fresh"))
+	assert.Equal(t, chain.InvalidateTag("user:42"), nil)
+	checkChainMiss(t, chain, "key")
+
+	// values of the loader are stored with its tags
+	chain.Revalidation = nil
+	val, err := chain.GetOrLoadWithTags("loaded", func() ([]byte, []int, []string, error) {
+		return []byte("v"), []int{60, 60}, []string{"pages"}, nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("v"))
+	checkChainHit(t, chain, "loaded", []byte("v"))
+	assert.Equal(t, chain.InvalidateTag("pages"), nil)
+	checkChainMiss(t, chain, "loaded")
+
+	_, err = chain.GetOrLoadWithTags("bad", func() ([]byte, []int, []string, error) {
+		return []byte("v"), []int{60, 60}, []string{"\x00user:"}, nil
+	})
+	assert.Equal(t, err != nil, true)
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestChainCacheTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	chain.Tracer = provider.Tracer("chaincache")
+
+	fc2.Set("key", []byte("value"), 60)
+	val, err := chain.Get("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, []byte("value"))
+
+	// level spans end before the chain span
+	spans := exporter.GetSpans()
+	assert.Equal(t, len(spans), 4)
+	assert.Equal(t, spans[0].Name, "chaincache.level.Get")
+	assert.Equal(t, spanAttr(spans[0], chaincache.ATTR_LEVEL).AsInt64(), int64(0))
+	assert.Equal(t, spanAttr(spans[0], chaincache.ATTR_HIT).AsBool(), false)
+	assert.Equal(t, spans[1].Name, "chaincache.level.Get")
+	assert.Equal(t, spanAttr(spans[1], chaincache.ATTR_LEVEL).AsInt64(), int64(1))
+	assert.Equal(t, spanAttr(spans[1], chaincache.ATTR_HIT).AsBool(), true)
+	assert.Equal(t, spans[2].Name, "chaincache.level.Backfill")
+	assert.Equal(t, spans[3].Name, "chaincache.Get")
+	assert.Equal(t, spanAttr(spans[3], chaincache.ATTR_HIT_LEVEL).AsInt64(), int64(1))
+	assert.Equal(t, spanAttr(spans[3], chaincache.ATTR_PAYLOAD_SIZE).AsInt64(), int64(5))
+	assert.Equal(t, spanAttr(spans[3], chaincache.ATTR_KEY_HASH).AsString() != "", true)
+	for _, span := range spans[:3] {
+		assert.Equal(t, span.Parent.SpanID(), spans[3].SpanContext.SpanID())
+	}
+
+	exporter.Reset()
+	chain.Get("missed")
+	spans = exporter.GetSpans()
+	assert.Equal(t, len(spans), 3)
+	assert.Equal(t, spanAttr(spans[2], chaincache.ATTR_HIT_LEVEL).AsInt64(), int64(-1))
+
+	exporter.Reset()
+	chain.Set("key", []byte("value"), []int{60, 120})
+	chain.Del("key")
+	spans = exporter.GetSpans()
+	assert.Equal(t, len(spans), 6)
+	assert.Equal(t, spans[1].Name, "chaincache.level.Set")
+	assert.Equal(t, spanAttr(spans[1], chaincache.ATTR_TTL).AsInt64(), int64(120))
+	assert.Equal(t, spans[2].Name, "chaincache.Set")
+	assert.Equal(t, spans[5].Name, "chaincache.Del")
+
+	// no spans without a tracer
+	exporter.Reset()
+	chain.Tracer = nil
+	chain.Get("key")
+	assert.Equal(t, len(exporter.GetSpans()), 0)
+}
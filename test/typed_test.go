@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testUser struct {
+	ID   int
+	Name string
+}
+
+func testCodec[V any](t *testing.T, codec chaincache.Codec[V], v V, eq func(a, b V) bool) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	cache := chaincache.NewTypedCache[int, V](fc, codec)
+
+	err := cache.Set(42, v, 60)
+	assert.Equal(t, err, nil)
+	got, ttl, err := cache.GetWithTTL(42)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, 60)
+	assert.Equal(t, eq(got, v), true)
+	checkHit(t, fc, "42", mustMarshal(t, codec, v))
+
+	_, err = cache.Get(43)
+	assert.Equal(t, err, chaincache.ErrMiss)
+	err = cache.Del(42)
+	assert.Equal(t, err, nil)
+	_, err = cache.Get(42)
+	assert.Equal(t, err, chaincache.ErrMiss)
+}
+
+func mustMarshal[V any](t *testing.T, codec chaincache.Codec[V], v V) []byte {
+	data, err := codec.Marshal(v)
+	assert.Equal(t, err, nil)
+	return data
+}
+
+func TestTypedCacheCodecs(t *testing.T) {
+	user := testUser{ID: 1, Name: "user"}
+	sameUser := func(a, b testUser) bool { return a == b }
+	testCodec[testUser](t, chaincache.JSONCodec[testUser]{}, user, sameUser)
+	testCodec[testUser](t, chaincache.GobCodec[testUser]{}, user, sameUser)
+	testCodec[[]byte](t, chaincache.RawCodec{}, []byte("raw"), func(a, b []byte) bool { return string(a) == string(b) })
+	testCodec[*wrapperspb.StringValue](t, chaincache.ProtoCodec[*wrapperspb.StringValue]{}, wrapperspb.String("proto"),
+		func(a, b *wrapperspb.StringValue) bool { return proto.Equal(a, b) })
+}
+
+func TestTypedChainCache(t *testing.T) {
+	fc1, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	fc2, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	chain, _ := chaincache.NewChainCache(fc1, fc2)
+	cache := chaincache.NewTypedChainCache[string, testUser](chain, chaincache.CapTTLPolicy{10}, chaincache.JSONCodec[testUser]{})
+
+	err := cache.Set("u1", testUser{ID: 1}, 60)
+	assert.Equal(t, err, nil)
+	_, ttl, _ := fc1.GetWithTTL("u1")
+	assert.Equal(t, ttl, 10)
+	_, ttl, _ = fc2.GetWithTTL("u1")
+	assert.Equal(t, ttl, 60)
+
+	loads := 0
+	loader := func() (testUser, []int, error) {
+		loads++
+		return testUser{ID: 2, Name: "loaded"}, []int{30, 60}, nil
+	}
+	for i := 0; i < 3; i++ {
+		user, err := cache.GetOrLoad("u2", loader)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, user, testUser{ID: 2, Name: "loaded"})
+	}
+	assert.Equal(t, loads, 1)
+
+	err = cache.SetLevels("u3", testUser{ID: 3}, []int{5, 6})
+	assert.Equal(t, err, nil)
+	fc1.Del("u3")
+	user, ttl, err := cache.GetWithTTL("u3")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, user.ID, 3)
+	assert.Equal(t, ttl, 6)
+
+	fc1.Set("broken", []byte("{"), 60)
+	_, err = cache.Get("broken")
+	assert.Equal(t, err != nil, true)
+}
+
+// ttlCountingCacher counts lookups asking for the rest of TTL
+type ttlCountingCacher struct {
+	*chaincache.Freecacher
+	ttlLookups int32
+}
+
+func (c *ttlCountingCacher) GetWithTTLCtx(ctx context.Context, key string) ([]byte, int, error) {
+	atomic.AddInt32(&c.ttlLookups, 1)
+	return c.Freecacher.GetWithTTLCtx(ctx, key)
+}
+
+func TestTypedCacheGetWithoutTTL(t *testing.T) {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	cacher := &ttlCountingCacher{Freecacher: fc}
+	users := chaincache.NewTypedCache[int, testUser](cacher, chaincache.JSONCodec[testUser]{})
+	assert.Equal(t, users.Set(42, testUser{Name: "name"}, 60), nil)
+
+	// remote cachers pay a round-trip for the TTL, plain Get does not ask for it
+	user, err := users.Get(42)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, user.Name, "name")
+	assert.Equal(t, atomic.LoadInt32(&cacher.ttlLookups), int32(0))
+
+	_, ttl, err := users.GetWithTTL(42)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, 60)
+	assert.Equal(t, atomic.LoadInt32(&cacher.ttlLookups), int32(1))
+}
@@ -0,0 +1,298 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/n1ord/chaincache"
+)
+
+var errWrite = fmt.Errorf("write failed")
+
+// gatedCacher holds writes until gate is closed and fails the first fails of them,
+// entered signals that a write is started
+type gatedCacher struct {
+	*chaincache.Freecacher
+	gate    chan struct{}
+	entered chan struct{}
+	fails   int32
+	writes  int32
+}
+
+func newGatedCacher(open bool) *gatedCacher {
+	fc, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	c := &gatedCacher{
+		Freecacher: fc,
+		gate:       make(chan struct{}),
+		entered:    make(chan struct{}, 1),
+	}
+	if open {
+		close(c.gate)
+	}
+	return c
+}
+
+func (c *gatedCacher) write() error {
+	select {
+	case c.entered <- struct{}{}:
+	default:
+	}
+	<-c.gate
+	if atomic.AddInt32(&c.fails, -1) >= 0 {
+		return errWrite
+	}
+	atomic.AddInt32(&c.writes, 1)
+	return nil
+}
+
+func (c *gatedCacher) SetCtx(ctx context.Context, key string, payload []byte, ttl int) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.Freecacher.SetCtx(ctx, key, payload, ttl)
+}
+
+func (c *gatedCacher) DelCtx(ctx context.Context, key string) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.Freecacher.DelCtx(ctx, key)
+}
+
+func (c *gatedCacher) MSetCtx(ctx context.Context, items []chaincache.Item) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.Freecacher.MSetCtx(ctx, items)
+}
+
+func (c *gatedCacher) MDelCtx(ctx context.Context, keys []string) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.Freecacher.MDelCtx(ctx, keys)
+}
+
+func TestChainCacheWriteBehind(t *testing.T) {
+	local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	remote := newGatedCacher(false)
+	chain, _ := chaincache.NewChainCache(local, remote)
+	err := chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1, Workers: 4})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1}) != nil, true)
+	ttls := []int{60, 600}
+
+	// the local level is written at once, the remote one waits for the worker
+	assert.Equal(t, chain.Set("key1", []byte("value1"), ttls), nil)
+	<-remote.entered
+	assert.Equal(t, chain.Set("key1", []byte("value2"), ttls), nil)
+	checkHit(t, local, "key1", []byte("value2"))
+	checkMiss(t, remote.Freecacher, "key1")
+	assert.Equal(t, chain.Stats().WriteBehindQueue, uint64(1))
+
+	close(remote.gate)
+	chain.FlushWriteBehind()
+	assert.Equal(t, chain.Stats().WriteBehindQueue, uint64(0))
+	// writes of a key keep their order
+	checkHit(t, remote.Freecacher, "key1", []byte("value2"))
+	_, ttl, _ := remote.Freecacher.GetWithTTL("key1")
+	assert.Equal(t, ttl, 600)
+
+	assert.Equal(t, chain.Del("key1"), nil)
+	checkMiss(t, local, "key1")
+	chain.FlushWriteBehind()
+	checkMiss(t, remote.Freecacher, "key1")
+
+	items := make([]chaincache.Item, 10)
+	keys := make([]string, len(items))
+	for ix := range items {
+		keys[ix] = fmt.Sprintf("batch%d", ix)
+		items[ix] = chaincache.Item{Key: keys[ix], Value: []byte("value")}
+	}
+	assert.Equal(t, chain.MSet(items, ttls), nil)
+	chain.FlushWriteBehind()
+	for _, key := range keys {
+		checkHit(t, remote.Freecacher, key, []byte("value"))
+	}
+	assert.Equal(t, chain.MDel(keys), nil)
+	chain.FlushWriteBehind()
+	for _, key := range keys {
+		checkMiss(t, remote.Freecacher, key)
+	}
+	stats := chain.Stats()
+	assert.Equal(t, stats.WriteBehindDropped, uint64(0))
+	assert.Equal(t, stats.WriteBehindFailed, uint64(0))
+
+	// Close writes the queued changes
+	for ix := 0; ix < 100; ix++ {
+		chain.Set(fmt.Sprintf("close%d", ix), []byte("value"), ttls)
+	}
+	writes := atomic.LoadInt32(&remote.writes)
+	chain.Close()
+	assert.Equal(t, atomic.LoadInt32(&remote.writes)-writes, int32(100))
+}
+
+func TestChainCacheWriteBehindBackpressure(t *testing.T) {
+	for _, policy := range []chaincache.BackpressurePolicy{chaincache.BACKPRESSURE_DROP, chaincache.BACKPRESSURE_DROP_OLDEST} {
+		local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		remote := newGatedCacher(false)
+		chain, _ := chaincache.NewChainCache(local, remote)
+		err := chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1, QueueSize: 1, Backpressure: policy})
+		assert.Equal(t, err, nil)
+		ttls := []int{60, 600}
+
+		chain.Set("first", []byte("value"), ttls)
+		<-remote.entered
+		chain.Set("second", []byte("value"), ttls)
+		chain.Set("third", []byte("value"), ttls)
+		assert.Equal(t, chain.Stats().WriteBehindDropped, uint64(1))
+		// every write reaches the local level
+		checkHit(t, local, "third", []byte("value"))
+
+		close(remote.gate)
+		chain.FlushWriteBehind()
+		checkHit(t, remote.Freecacher, "first", []byte("value"))
+		if policy == chaincache.BACKPRESSURE_DROP {
+			checkHit(t, remote.Freecacher, "second", []byte("value"))
+			checkMiss(t, remote.Freecacher, "third")
+		} else {
+			checkMiss(t, remote.Freecacher, "second")
+			checkHit(t, remote.Freecacher, "third", []byte("value"))
+		}
+		chain.Close()
+	}
+}
+
+func TestChainCacheWriteBehindRetry(t *testing.T) {
+	local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	remote := newGatedCacher(true)
+	chain, _ := chaincache.NewChainCache(local, remote)
+	observer := &recordingObserver{}
+	chain.Observer = observer
+	err := chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1, Retries: 2, RetryDelay: time.Millisecond})
+	assert.Equal(t, err, nil)
+	ttls := []int{60, 600}
+
+	atomic.StoreInt32(&remote.fails, 2)
+	assert.Equal(t, chain.Set("retried", []byte("value"), ttls), nil)
+	chain.FlushWriteBehind()
+	checkHit(t, remote.Freecacher, "retried", []byte("value"))
+	assert.Equal(t, chain.Stats().WriteBehindFailed, uint64(0))
+
+	atomic.StoreInt32(&remote.fails, 3)
+	observer.take()
+	assert.Equal(t, chain.Set("failed", []byte("value"), ttls), nil)
+	chain.FlushWriteBehind()
+	checkMiss(t, remote.Freecacher, "failed")
+	assert.Equal(t, chain.Stats().WriteBehindFailed, uint64(1))
+	assert.Equal(t, observer.take(), []string{"set failed", "error 1 writebehind write failed"})
+	chain.Close()
+}
+
+func TestChainCacheWriteBehindInvalidation(t *testing.T) {
+	bus := chaincache.NewLocalInvalidationBus()
+	remote := newGatedCacher(false)
+	pods := make([]*chaincache.ChainCache, 2)
+	for ix := range pods {
+		pods[ix], _ = newPod(t, remote, bus)
+		err := pods[ix].EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1})
+		assert.Equal(t, err, nil)
+	}
+	ttls := []int{60, 600}
+
+	remote.Freecacher.Set("key", []byte("v1"), 600)
+	checkChainHit(t, pods[1], "key", []byte("v1"))
+
+	// the key is published after the remote level is written, a read before that keeps v1
+	// and the read after the flush does not backfill v1 from the remote level
+	pods[0].Set("key", []byte("v2"), ttls)
+	<-remote.entered
+	checkChainHit(t, pods[1], "key", []byte("v1"))
+	close(remote.gate)
+	pods[0].FlushWriteBehind()
+	checkChainHit(t, pods[1], "key", []byte("v2"))
+
+	pods[0].Del("key")
+	pods[0].FlushWriteBehind()
+	checkChainMiss(t, pods[1], "key")
+
+	pods[0].MSet([]chaincache.Item{{Key: "a", Value: []byte("a1")}}, ttls)
+	pods[0].FlushWriteBehind()
+	checkChainHit(t, pods[1], "a", []byte("a1"))
+	pods[0].MSet([]chaincache.Item{{Key: "a", Value: []byte("a2")}}, ttls)
+	pods[0].FlushWriteBehind()
+	checkChainHit(t, pods[1], "a", []byte("a2"))
+	pods[0].MDel([]string{"a"})
+	pods[0].FlushWriteBehind()
+	checkChainMiss(t, pods[1], "a")
+
+	for _, pod := range pods {
+		pod.Close()
+	}
+}
+
+func TestChainCacheWriteBehindKeepsDeletes(t *testing.T) {
+	for _, policy := range []chaincache.BackpressurePolicy{chaincache.BACKPRESSURE_DROP, chaincache.BACKPRESSURE_DROP_OLDEST} {
+		local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+		remote := newGatedCacher(false)
+		remote.Freecacher.Set("deleted", []byte("value"), 600)
+		chain, _ := chaincache.NewChainCache(local, remote)
+		err := chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1, QueueSize: 1, Backpressure: policy})
+		assert.Equal(t, err, nil)
+		ttls := []int{60, 600}
+
+		chain.Set("first", []byte("value"), ttls)
+		<-remote.entered
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(remote.gate)
+		}()
+		// the write after the full queue waits for the worker instead of dropping the delete
+		if policy == chaincache.BACKPRESSURE_DROP {
+			chain.Set("second", []byte("value"), ttls)
+			chain.Del("deleted")
+		} else {
+			chain.Del("deleted")
+			chain.Set("second", []byte("value"), ttls)
+		}
+		chain.FlushWriteBehind()
+		checkMiss(t, remote.Freecacher, "deleted")
+		checkHit(t, remote.Freecacher, "second", []byte("value"))
+		assert.Equal(t, chain.Stats().WriteBehindDropped, uint64(0))
+		chain.Close()
+	}
+}
+
+func TestChainCacheWriteBehindDelBackfill(t *testing.T) {
+	local, _ := chaincache.NewFreeCacher(1024 * 1024 * 10)
+	remote := newGatedCacher(false)
+	remote.Freecacher.Set("key", []byte("old"), 600)
+	chain, _ := chaincache.NewChainCache(local, remote)
+	err := chain.EnableWriteBehind(chaincache.WriteBehind{LocalLevels: 1})
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, chain.Del("key"), nil)
+	<-remote.entered
+	// the queued delete has not reached the remote level, the lookup backfills the old value
+	checkChainHit(t, chain, "key", []byte("old"))
+	close(remote.gate)
+	chain.FlushWriteBehind()
+	checkMiss(t, remote.Freecacher, "key")
+	checkMiss(t, local, "key")
+	checkChainMiss(t, chain, "key")
+
+	remote.Freecacher.MSet([]chaincache.Item{{Key: "a", Value: []byte("old"), TTL: 600}})
+	remote.gate = make(chan struct{})
+	assert.Equal(t, chain.MDel([]string{"a"}), nil)
+	<-remote.entered
+	checkChainHit(t, chain, "a", []byte("old"))
+	close(remote.gate)
+	chain.FlushWriteBehind()
+	checkMiss(t, local, "a")
+	checkChainMiss(t, chain, "a")
+	chain.Close()
+}
@@ -0,0 +1,118 @@
+package chaincache
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span attributes, keys are never exported as is, only their hash
+const (
+	ATTR_KEY_HASH     = attribute.Key("cache.key_hash")
+	ATTR_LEVEL        = attribute.Key("cache.level")
+	ATTR_HIT_LEVEL    = attribute.Key("cache.hit_level")
+	ATTR_HIT          = attribute.Key("cache.hit")
+	ATTR_PAYLOAD_SIZE = attribute.Key("cache.payload_size")
+	ATTR_TTL          = attribute.Key("cache.ttl")
+	ATTR_KEYS         = attribute.Key("cache.keys")
+	ATTR_DB_SYSTEM    = attribute.Key("db.system")
+	ATTR_DB_OPERATION = attribute.Key("db.operation")
+)
+
+// span wraps trace.Span to do nothing when tracing is disabled,
+// so the hot path neither allocates nor builds attributes without a tracer
+type span struct {
+	trace.Span
+}
+
+// startSpan starts a span named name for the key, nil tracer returns ctx and a zero span
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, key chainKey) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := tracer.Start(ctx, name, trace.WithAttributes(ATTR_KEY_HASH.String(keyHash(key))))
+	return ctx, span{s}
+}
+
+// detachSpan returns a context for background work outliving ctx: it is never canceled,
+// spans started with it are children of the span of ctx
+func detachSpan(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// startBatchSpan starts a span named name for a batch of n keys
+func startBatchSpan(ctx context.Context, tracer trace.Tracer, name string, n int) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := tracer.Start(ctx, name, trace.WithAttributes(ATTR_KEYS.Int(n)))
+	return ctx, span{s}
+}
+
+func (s span) setInt(key attribute.Key, value int) {
+	if s.Span != nil {
+		s.Span.SetAttributes(key.Int(value))
+	}
+}
+
+func (s span) setBool(key attribute.Key, value bool) {
+	if s.Span != nil {
+		s.Span.SetAttributes(key.Bool(value))
+	}
+}
+
+// end ends the span marking it failed by err, misses and negative hits are not failures
+func (s span) end(err error) {
+	if s.Span == nil {
+		return
+	}
+	if err != nil && err != ErrMiss && err != ErrNegativeHit {
+		s.Span.RecordError(err)
+		s.Span.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
+
+// keyHash identifies the key in traces without exposing it
+func keyHash(key chainKey) string {
+	h := fnv.New64a()
+	if key.bytes {
+		h.Write(key.b)
+	} else {
+		h.Write([]byte(key.s))
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// startLevelSpan starts a span of an operation on the level of a chain
+func startLevelSpan(ctx context.Context, tracer trace.Tracer, name string, level int) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := tracer.Start(ctx, name, trace.WithAttributes(ATTR_LEVEL.Int(level)))
+	return ctx, span{s}
+}
+
+// startDBSpan starts a span of a request to a remote storage
+func startDBSpan(ctx context.Context, tracer trace.Tracer, system string, op string, key chainKey) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := startSpan(ctx, tracer, system+"."+op, key)
+	s.SetAttributes(ATTR_DB_SYSTEM.String(system), ATTR_DB_OPERATION.String(op))
+	return ctx, s
+}
+
+// startDBBatchSpan starts a span of a batch request to a remote storage
+func startDBBatchSpan(ctx context.Context, tracer trace.Tracer, system string, op string, n int) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := startBatchSpan(ctx, tracer, system+"."+op, n)
+	s.SetAttributes(ATTR_DB_SYSTEM.String(system), ATTR_DB_OPERATION.String(op))
+	return ctx, s
+}
@@ -0,0 +1,158 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// TypedCache gives typed access to a Cacher: keys are formatted by KeyFunc, values are
+// converted by Codec. Errors of the cacher (ErrMiss, ErrNegativeHit, ...) are returned as is
+type TypedCache[K any, V any] struct {
+	cacher ContextCacher
+	codec  Codec[V]
+
+	// KeyFunc formats keys, by default strings are used as is, integers, []byte and
+	// fmt.Stringer are converted to string, other types are formatted by fmt.Sprint
+	KeyFunc func(K) string
+}
+
+func NewTypedCache[K any, V any](cacher Cacher, codec Codec[V]) *TypedCache[K, V] {
+	return &TypedCache[K, V]{
+		cacher:  AsContextCacher(cacher),
+		codec:   codec,
+		KeyFunc: formatKey[K],
+	}
+}
+
+func formatKey[K any](key K) string {
+	switch k := any(key).(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	case int:
+		return strconv.Itoa(k)
+	case int64:
+		return strconv.FormatInt(k, 10)
+	case int32:
+		return strconv.FormatInt(int64(k), 10)
+	case uint:
+		return strconv.FormatUint(uint64(k), 10)
+	case uint64:
+		return strconv.FormatUint(k, 10)
+	case uint32:
+		return strconv.FormatUint(uint64(k), 10)
+	case fmt.Stringer:
+		return k.String()
+	}
+	return fmt.Sprint(key)
+}
+
+func (c *TypedCache[K, V]) Get(key K) (V, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+func (c *TypedCache[K, V]) GetCtx(ctx context.Context, key K) (V, error) {
+	var zero V
+	data, err := c.cacher.GetCtx(ctx, c.KeyFunc(key))
+	if err != nil {
+		return zero, err
+	}
+	return c.decode(data)
+}
+
+func (c *TypedCache[K, V]) GetWithTTL(key K) (V, int, error) {
+	return c.GetWithTTLCtx(context.Background(), key)
+}
+
+func (c *TypedCache[K, V]) GetWithTTLCtx(ctx context.Context, key K) (V, int, error) {
+	var zero V
+	data, ttl, err := c.cacher.GetWithTTLCtx(ctx, c.KeyFunc(key))
+	if err != nil {
+		return zero, 0, err
+	}
+	v, err := c.decode(data)
+	if err != nil {
+		return zero, 0, err
+	}
+	return v, ttl, nil
+}
+
+func (c *TypedCache[K, V]) decode(data []byte) (V, error) {
+	v, err := c.codec.Unmarshal(data)
+	if err != nil {
+		var zero V
+		return zero, fmt.Errorf("cannot decode cached value: %s", err)
+	}
+	return v, nil
+}
+
+func (c *TypedCache[K, V]) Set(key K, v V, ttl int) error {
+	return c.SetCtx(context.Background(), key, v, ttl)
+}
+
+func (c *TypedCache[K, V]) SetCtx(ctx context.Context, key K, v V, ttl int) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cannot encode value: %s", err)
+	}
+	return c.cacher.SetCtx(ctx, c.KeyFunc(key), data, ttl)
+}
+
+func (c *TypedCache[K, V]) Del(key K) error {
+	return c.cacher.DelCtx(context.Background(), c.KeyFunc(key))
+}
+
+func (c *TypedCache[K, V]) DelCtx(ctx context.Context, key K) error {
+	return c.cacher.DelCtx(ctx, c.KeyFunc(key))
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// TypedChainCache is TypedCache over a chain, TTL of Set is spread over the levels by the policy
+// of ChainCacher, SetLevels and GetOrLoad keep per-level TTLs of the chain API
+type TypedChainCache[K any, V any] struct {
+	*TypedCache[K, V]
+	chain *ChainCache
+}
+
+func NewTypedChainCache[K any, V any](chain *ChainCache, policy TTLPolicy, codec Codec[V]) *TypedChainCache[K, V] {
+	return &TypedChainCache[K, V]{
+		TypedCache: NewTypedCache[K, V](NewChainCacher(chain, policy), codec),
+		chain:      chain,
+	}
+}
+
+// SetLevels stores the value with its own TTL for every level of the chain
+func (c *TypedChainCache[K, V]) SetLevels(key K, v V, ttlSeconds []int) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cannot encode value: %s", err)
+	}
+	return c.chain.Set(c.KeyFunc(key), data, ttlSeconds)
+}
+
+// GetOrLoad is the typed ChainCache.GetOrLoad
+func (c *TypedChainCache[K, V]) GetOrLoad(key K, loader func() (V, []int, error)) (V, error) {
+	return c.GetOrLoadCtx(context.Background(), key, loader)
+}
+
+func (c *TypedChainCache[K, V]) GetOrLoadCtx(ctx context.Context, key K, loader func() (V, []int, error)) (V, error) {
+	var zero V
+	data, err := c.chain.GetOrLoadCtx(ctx, c.KeyFunc(key), func() ([]byte, []int, error) {
+		v, ttls, err := loader()
+		if err != nil {
+			return nil, ttls, err
+		}
+		data, err := c.codec.Marshal(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot encode value: %s", err)
+		}
+		return data, ttls, nil
+	})
+	if err != nil {
+		return zero, err
+	}
+	return c.decode(data)
+}
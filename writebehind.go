@@ -0,0 +1,371 @@
+package chaincache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// capacity of the queue of a write-behind worker when WriteBehind.QueueSize is not set
+const DEFAULT_WRITE_BEHIND_QUEUE = 1024
+
+// BackpressurePolicy selects what a write does when the write-behind queue is full
+type BackpressurePolicy uint8
+
+const (
+	// the write waits for a free place in the queue
+	BACKPRESSURE_BLOCK BackpressurePolicy = iota
+	// the new write is dropped, a delete waits for a free place instead
+	BACKPRESSURE_DROP
+	// the oldest queued write is dropped to make place for the new one, a queued delete is moved
+	// to the tail instead
+	BACKPRESSURE_DROP_OLDEST
+)
+
+// WriteBehind settings of ChainCache.EnableWriteBehind
+type WriteBehind struct {
+	// the first LocalLevels levels are written synchronously, the rest are written by workers
+	LocalLevels int
+	// number of workers, every key is served by the same worker, so its writes keep their order, default=1
+	Workers int
+	// capacity of the queue of every worker, default=DEFAULT_WRITE_BEHIND_QUEUE
+	QueueSize    int
+	Backpressure BackpressurePolicy
+	// attempts after a failed write and the pause before each of them
+	Retries    int
+	RetryDelay time.Duration
+}
+
+type writeOp uint8
+
+const (
+	writeSet writeOp = iota
+	writeDel
+	writeMSet
+	writeMDel
+	// nothing to write, done is closed when the worker reaches the job
+	writeBarrier
+)
+
+type writeJob struct {
+	op   writeOp
+	ctx  context.Context
+	key  chainKey
+	data []byte
+	// TTLs of all levels of a set
+	ttls []int
+	// items of all levels of an mset
+	items [][]Item
+	keys  []string
+	done  chan struct{}
+}
+
+type writeBehind struct {
+	WriteBehind
+	// closed is guarded by mu, enqueueing holds it for reading, so closing waits for blocked writes
+	mu     sync.RWMutex
+	closed bool
+	queues []chan writeJob
+	wg     sync.WaitGroup
+}
+
+// EnableWriteBehind makes Set, Del and their batch variants return after the local levels are written,
+// remote levels get the changes from queues served by background workers. A change failed after
+// all retries is reported to the Observer with op writebehind. Deletes of remote levels are queued
+// too, so they are never overtaken by an earlier write of the key. A written delete evicts the keys
+// from the local levels again, dropping old values backfilled while it was queued. Keys are published
+// to the invalidation bus by the workers once the remote levels are written, so other chains do not
+// backfill the old remote value. Close flushes the queues. It has to be called before the chain is used
+func (c *ChainCache) EnableWriteBehind(cfg WriteBehind) error {
+	if !c.inited {
+		return ErrNotInited
+	}
+	if c.writeBehind != nil {
+		return fmt.Errorf("write-behind is already enabled")
+	}
+	if cfg.LocalLevels < 0 || cfg.LocalLevels >= len(c.chain) {
+		return fmt.Errorf("local levels must be in range 0..%d", len(c.chain)-1)
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DEFAULT_WRITE_BEHIND_QUEUE
+	}
+	wb := &writeBehind{
+		WriteBehind: cfg,
+		queues:      make([]chan writeJob, cfg.Workers),
+	}
+	for ix := range wb.queues {
+		wb.queues[ix] = make(chan writeJob, cfg.QueueSize)
+		wb.wg.Add(1)
+		go c.writeWorker(wb, wb.queues[ix])
+	}
+	c.writeBehind = wb
+	return nil
+}
+
+// FlushWriteBehind waits until the changes queued before the call are written
+func (c *ChainCache) FlushWriteBehind() {
+	wb := c.writeBehind
+	if wb == nil {
+		return
+	}
+	wb.mu.RLock()
+	if wb.closed {
+		wb.mu.RUnlock()
+		return
+	}
+	barriers := make([]chan struct{}, len(wb.queues))
+	for ix, queue := range wb.queues {
+		barriers[ix] = make(chan struct{})
+		queue <- writeJob{op: writeBarrier, done: barriers[ix]}
+	}
+	wb.mu.RUnlock()
+	for _, done := range barriers {
+		<-done
+	}
+}
+
+// stopWriteBehind writes the queued changes and stops the workers
+func (c *ChainCache) stopWriteBehind() {
+	wb := c.writeBehind
+	if wb == nil {
+		return
+	}
+	wb.mu.Lock()
+	wb.closed = true
+	for _, queue := range wb.queues {
+		close(queue)
+	}
+	wb.mu.Unlock()
+	wb.wg.Wait()
+	c.writeBehind = nil
+}
+
+// localLevels returns the number of levels written synchronously
+func (c *ChainCache) localLevels() int {
+	if c.writeBehind == nil {
+		return len(c.chain)
+	}
+	return c.writeBehind.LocalLevels
+}
+
+func (wb *writeBehind) queue(key string) chan writeJob {
+	if len(wb.queues) == 1 {
+		return wb.queues[0]
+	}
+	return wb.queues[xxhash.Sum64String(key)%uint64(len(wb.queues))]
+}
+
+func (wb *writeBehind) depth() int {
+	depth := 0
+	for _, queue := range wb.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// enqueue puts the job into the queue applying the backpressure policy
+func (c *ChainCache) enqueue(queue chan writeJob, job writeJob) error {
+	wb := c.writeBehind
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	if wb.closed {
+		return ErrNotInited
+	}
+	switch {
+	case wb.Backpressure == BACKPRESSURE_DROP && !job.deletes():
+		select {
+		case queue <- job:
+		default:
+			atomic.AddUint64(&c.writeBehindDropped, 1)
+		}
+	case wb.Backpressure == BACKPRESSURE_DROP_OLDEST:
+		for {
+			select {
+			case queue <- job:
+				return nil
+			default:
+			}
+			select {
+			case old := <-queue:
+				if old.op == writeBarrier {
+					// everything queued before the barrier is written already
+					close(old.done)
+					continue
+				}
+				if old.deletes() {
+					// a dropped delete would leave the keys alive in the remote levels. Applied after
+					// later writes of the keys it turns them into misses, which is never stale
+					queue <- old
+					queue <- job
+					return nil
+				}
+				atomic.AddUint64(&c.writeBehindDropped, 1)
+			default:
+			}
+		}
+	default:
+		queue <- job
+	}
+	return nil
+}
+
+// writeBehindSet queues a set of the remote levels, data and TTLs are copied since the caller owns them
+func (c *ChainCache) writeBehindSet(ctx context.Context, key chainKey, data []byte, ttlSeconds []int) error {
+	if key.bytes {
+		key = bytesKey(append([]byte(nil), key.b...))
+	}
+	return c.enqueue(c.writeBehind.queue(key.String()), writeJob{
+		op:   writeSet,
+		ctx:  detachSpan(ctx),
+		key:  key,
+		data: append([]byte(nil), data...),
+		ttls: append([]int(nil), ttlSeconds...),
+	})
+}
+
+func (c *ChainCache) writeBehindDel(ctx context.Context, key chainKey) error {
+	if key.bytes {
+		key = bytesKey(append([]byte(nil), key.b...))
+	}
+	return c.enqueue(c.writeBehind.queue(key.String()), writeJob{op: writeDel, ctx: detachSpan(ctx), key: key})
+}
+
+// writeBehindMSet queues items of the remote levels split by the queues of their keys
+func (c *ChainCache) writeBehindMSet(ctx context.Context, levels [][]Item) error {
+	wb := c.writeBehind
+	jobs := make(map[chan writeJob][][]Item, len(wb.queues))
+	for i, item := range levels[0] {
+		queue := wb.queue(item.Key)
+		items, ok := jobs[queue]
+		if !ok {
+			items = make([][]Item, len(levels))
+		}
+		for ix := wb.LocalLevels; ix < len(levels); ix++ {
+			item := levels[ix][i]
+			item.Value = append([]byte(nil), item.Value...)
+			items[ix] = append(items[ix], item)
+		}
+		jobs[queue] = items
+	}
+	ctx = detachSpan(ctx)
+	for queue, items := range jobs {
+		if err := c.enqueue(queue, writeJob{op: writeMSet, ctx: ctx, items: items}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ChainCache) writeBehindMDel(ctx context.Context, keys []string) error {
+	wb := c.writeBehind
+	jobs := make(map[chan writeJob][]string, len(wb.queues))
+	for _, key := range keys {
+		queue := wb.queue(key)
+		jobs[queue] = append(jobs[queue], key)
+	}
+	ctx = detachSpan(ctx)
+	for queue, keys := range jobs {
+		if err := c.enqueue(queue, writeJob{op: writeMDel, ctx: ctx, keys: keys}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ChainCache) writeWorker(wb *writeBehind, queue chan writeJob) {
+	defer wb.wg.Done()
+	for job := range queue {
+		if job.op == writeBarrier {
+			close(job.done)
+			continue
+		}
+		written := true
+		for ix := wb.LocalLevels; ix < len(c.chain); ix++ {
+			err := c.writeLevel(job, ix)
+			for attempt := 0; err != nil && attempt < wb.Retries; attempt++ {
+				time.Sleep(wb.RetryDelay)
+				err = c.writeLevel(job, ix)
+			}
+			if err != nil {
+				c.notifyError(ix, "writebehind", err)
+				atomic.AddUint64(&c.writeBehindFailed, 1)
+				written = false
+			}
+		}
+		if written {
+			if job.deletes() {
+				c.evictLocal(wb, job)
+			}
+			c.publishJob(wb, job)
+		}
+	}
+}
+
+// evictLocal deletes the keys of the written delete from the local levels again, a lookup made
+// while the delete was queued may have backfilled them from the remote levels
+func (c *ChainCache) evictLocal(wb *writeBehind, job writeJob) {
+	for ix := 0; ix < wb.LocalLevels; ix++ {
+		var err error
+		if job.op == writeDel {
+			err = job.key.del(job.ctx, c.chain[ix])
+		} else {
+			err = c.chain[ix].MDelCtx(job.ctx, job.keys)
+		}
+		if err != nil && err != ErrMiss {
+			c.notifyError(ix, "writebehind", err)
+		}
+	}
+}
+
+// publishJob sends keys of the written job to other chains
+func (c *ChainCache) publishJob(wb *writeBehind, job writeJob) {
+	if c.invalidation == nil {
+		return
+	}
+	switch job.op {
+	case writeSet, writeDel:
+		c.publish(job.ctx, job.key.String())
+	case writeMSet:
+		c.publishItems(job.ctx, job.items[wb.LocalLevels])
+	case writeMDel:
+		c.publish(job.ctx, job.keys...)
+	}
+}
+
+// deletes reports if the job deletes keys
+func (job writeJob) deletes() bool {
+	return job.op == writeDel || job.op == writeMDel
+}
+
+func (c *ChainCache) writeLevel(job writeJob, ix int) error {
+	cacher := c.chain[ix]
+	switch job.op {
+	case writeSet:
+		lctx, sp := startLevelSpan(job.ctx, c.Tracer, "chaincache.level.Set", ix)
+		ttl := c.Jitter.keyTTL(job.key, job.ttls[ix])
+		sp.setInt(ATTR_TTL, ttl)
+		err := job.key.set(lctx, cacher, job.data, ttl)
+		sp.end(err)
+		return err
+	case writeDel:
+		lctx, sp := startLevelSpan(job.ctx, c.Tracer, "chaincache.level.Del", ix)
+		err := job.key.del(lctx, cacher)
+		if err == ErrMiss {
+			err = nil
+		}
+		sp.end(err)
+		return err
+	case writeMSet:
+		return cacher.MSetCtx(job.ctx, job.items[ix])
+	case writeMDel:
+		return cacher.MDelCtx(job.ctx, job.keys)
+	}
+	return nil
+}
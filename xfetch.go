@@ -0,0 +1,93 @@
+package chaincache
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// XFetch configures probabilistic early expiration used by GetXFetch, setting it also makes
+// GetOrLoad record recompute cost of loaded values. A hit is reported as
+// needing a refresh with probability growing as its expiration approaches, it is true when
+// cost * Beta * -ln(rand()) reaches the rest of TTL. So refreshes of hot keys are spread over
+// time without any coordination between processes
+type XFetch struct {
+	// Beta > 1 favors earlier refreshes, Beta < 1 later ones, zero is treated as 1
+	Beta float64
+	// DefaultCost is the recompute cost of entries stored without it
+	DefaultCost time.Duration
+}
+
+func (x *XFetch) shouldRefresh(ttl int, cost time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	beta := 1.
+	if x != nil {
+		if x.Beta > 0 {
+			beta = x.Beta
+		}
+		if cost == 0 {
+			cost = x.DefaultCost
+		}
+	}
+	if cost <= 0 {
+		return false
+	}
+	return -cost.Seconds()*beta*math.Log(rand.Float64()) >= float64(ttl)
+}
+
+// GetXFetch is Get which also reports if the caller should recompute the value before it expires.
+// The recompute cost is taken from the entry (see SetWithCost and GetOrLoad) or XFetch.DefaultCost,
+// nil XFetch means Beta = 1 and no default cost
+func (c *ChainCache) GetXFetch(key string) ([]byte, bool, error) {
+	return c.xfetch(context.Background(), stringKey(key))
+}
+
+func (c *ChainCache) GetXFetchCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	return c.xfetch(ctx, stringKey(key))
+}
+
+func (c *ChainCache) BGetXFetch(key []byte) ([]byte, bool, error) {
+	return c.xfetch(context.Background(), bytesKey(key))
+}
+
+func (c *ChainCache) BGetXFetchCtx(ctx context.Context, key []byte) ([]byte, bool, error) {
+	return c.xfetch(ctx, bytesKey(key))
+}
+
+// SetWithCost is Set which stores the time the payload took to compute, it is used by GetXFetch
+func (c *ChainCache) SetWithCost(key string, payload []byte, cost time.Duration, ttlSeconds []int) error {
+	return c.setRaw(context.Background(), stringKey(key), c.encodePayload(payload, cost), ttlSeconds)
+}
+
+func (c *ChainCache) SetWithCostCtx(ctx context.Context, key string, payload []byte, cost time.Duration, ttlSeconds []int) error {
+	return c.setRaw(ctx, stringKey(key), c.encodePayload(payload, cost), ttlSeconds)
+}
+
+func (c *ChainCache) BSetWithCost(key []byte, payload []byte, cost time.Duration, ttlSeconds []int) error {
+	return c.setRaw(context.Background(), bytesKey(key), c.encodePayload(payload, cost), ttlSeconds)
+}
+
+func (c *ChainCache) BSetWithCostCtx(ctx context.Context, key []byte, payload []byte, cost time.Duration, ttlSeconds []int) error {
+	return c.setRaw(ctx, bytesKey(key), c.encodePayload(payload, cost), ttlSeconds)
+}
+
+// GetEarlyRefreshes returns the number of hits reported by GetXFetch as needing a refresh
+func (c *ChainCache) GetEarlyRefreshes() uint64 {
+	return atomic.LoadUint64(&c.earlyRefreshes)
+}
+
+func (c *ChainCache) xfetch(ctx context.Context, key chainKey) ([]byte, bool, error) {
+	e, ttl, err := c.lookup(ctx, key, true)
+	if err != nil {
+		return nil, false, err
+	}
+	refresh := c.XFetch.shouldRefresh(ttl, e.cost)
+	if refresh {
+		atomic.AddUint64(&c.earlyRefreshes, 1)
+	}
+	return e.payload, refresh, nil
+}